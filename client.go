@@ -9,29 +9,50 @@ import (
 	"go.mongodb.org/mongo-driver/bson/bsonrw"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
 	"reflect"
 )
 
-func NewClient(url, username, password, dbName string) (*mongo.Client, error) {
-	opts := options.Client().SetRegistry(newMongoUUIDRegistry()).ApplyURI(url)
+// NewClient подключается к MongoDB и проверяет соединение ping-ом. Подключение и ping ограничены
+// сроком из WithConnectTimeout, по умолчанию DefaultConnectTimeout. Опции применяются поверх url
+func NewClient(url, username, password, dbName string, opts ...ClientOption) (*mongo.Client, error) {
+	cfg := &clientConfig{
+		connectTimeout: DefaultConnectTimeout,
+		clientOptions:  options.Client().SetRegistry(newMongoUUIDRegistry()).ApplyURI(url),
+	}
 	if username != "" && password != "" {
-		opts.SetAuth(options.Credential{
+		cfg.clientOptions.SetAuth(options.Credential{
 			Username: username, Password: password, AuthSource: dbName,
 		})
 	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if cfg.monitor == nil {
+		monitor, err := newCommandMonitor(otel.GetMeterProvider())
+		if err != nil {
+			return nil, fmt.Errorf("error creating command monitor: %w", err)
+		}
+		cfg.monitor = monitor
+	}
+	cfg.clientOptions.SetMonitor(cfg.monitor.eventMonitor())
 
 	ctx := context.Background()
+	if cfg.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.connectTimeout)
+		defer cancel()
+	}
 
-	client, err := mongo.Connect(ctx, opts)
+	client, err := mongo.Connect(ctx, cfg.clientOptions)
 	if err != nil {
-		fmt.Println("Error connecting to MongoDB")
-		return nil, err
+		return nil, fmt.Errorf("error connecting to MongoDB: %w", err)
 	}
 
-	err = client.Ping(ctx, nil)
-	if err != nil {
-		fmt.Println("Error pinging MongoDB")
-		return nil, err
+	if err = client.Ping(ctx, nil); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, fmt.Errorf("error pinging MongoDB: %w", err)
 	}
 
 	return client, nil
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	repoMongo "github.com/nikitalystsev/BookSmart-repo-mongo"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/migrate"
+	"github.com/sirupsen/logrus"
+	"os"
+	"text/tabwriter"
+)
+
+const usage = `usage: migrate [flags] <command>
+
+commands:
+  status   show applied and pending migrations
+  up       apply all pending migrations and create missing collections and indexes
+  down     revert the last applied migration
+
+flags:
+`
+
+func main() {
+	url := flag.String("url", os.Getenv("MONGO_URL"), "mongodb connection url")
+	username := flag.String("user", os.Getenv("MONGO_USERNAME"), "mongodb username")
+	password := flag.String("password", os.Getenv("MONGO_PASSWORD"), "mongodb password")
+	dbName := flag.String("db", os.Getenv("MONGO_DB_NAME"), "mongodb database name")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), *url, *username, *password, *dbName); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(command, url, username, password, dbName string) error {
+	ctx := context.Background()
+	logger := logrus.NewEntry(logrus.StandardLogger())
+
+	client, err := repoMongo.NewClient(url, username, password, dbName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = client.Disconnect(ctx) }()
+
+	migrator, err := migrate.NewMigrator(client.Database(dbName), migrate.Migrations, logger)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tSTATE\tAPPLIED AT\tDESCRIPTION")
+		for _, s := range statuses {
+			state, appliedAt := "pending", "-"
+			if s.Applied {
+				state, appliedAt = "applied", s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.Version, state, appliedAt, s.Description)
+		}
+
+		return w.Flush()
+	case "up":
+		applied, err := migrator.Up(ctx)
+		fmt.Printf("applied %d migration(s)\n", applied)
+		if err != nil {
+			return err
+		}
+
+		drifts, err := repoMongo.EnsureSchema(ctx, client.Database(dbName))
+		if err != nil {
+			return err
+		}
+		for _, drift := range drifts {
+			logger.Warnf("schema drift: %s", drift)
+		}
+
+		return nil
+	case "down":
+		reverted, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("reverted migration %d: %s\n", reverted.Version, reverted.Description)
+
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
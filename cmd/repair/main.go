@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	repoMongo "github.com/nikitalystsev/BookSmart-repo-mongo"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/impl"
+	"github.com/sirupsen/logrus"
+	"os"
+)
+
+const usage = `usage: repair [flags] <command>
+
+commands:
+  ratings   recompute rating_sum, rating_count and rating_avg of every book
+
+flags:
+`
+
+func main() {
+	url := flag.String("url", os.Getenv("MONGO_URL"), "mongodb connection url")
+	username := flag.String("user", os.Getenv("MONGO_USERNAME"), "mongodb username")
+	password := flag.String("password", os.Getenv("MONGO_PASSWORD"), "mongodb password")
+	dbName := flag.String("db", os.Getenv("MONGO_DB_NAME"), "mongodb database name")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), *url, *username, *password, *dbName); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(command, url, username, password, dbName string) error {
+	ctx := context.Background()
+	logger := logrus.NewEntry(logrus.StandardLogger())
+
+	client, err := repoMongo.NewClient(url, username, password, dbName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = client.Disconnect(ctx) }()
+
+	switch command {
+	case "ratings":
+		return impl.NewRatingRepo(client.Database(dbName), logger).RecomputeBookSummaries(ctx)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
@@ -0,0 +1,65 @@
+package dto
+
+import (
+	"github.com/nikitalystsev/BookSmart-services/core/dto"
+	"github.com/nikitalystsev/BookSmart-services/core/models"
+)
+
+// BookParamsDTO дополняет параметры поиска сервисов диапазонами и множественными значениями.
+// Непустые списки Rarities, Genres и Languages заменяют одиночные Rarity, Genre и Language,
+// а точные PublishingYear, AgeLimit и CopiesNumber имеют приоритет над диапазонами и AvailableOnly
+type BookParamsDTO struct {
+	dto.BookParamsDTO
+	PublishingYearFrom uint
+	PublishingYearTo   uint
+	AgeLimitMax        uint
+	Rarities           []string
+	Genres             []string
+	Languages          []string
+	AvailableOnly      bool
+	RatingAvgMin       float64
+}
+
+type BookSortField string
+
+const (
+	BookSortByTitle          BookSortField = "title"
+	BookSortByAuthor         BookSortField = "author"
+	BookSortByPublishingYear BookSortField = "publishing_year"
+	BookSortByCopiesNumber   BookSortField = "copies_number"
+	BookSortByRating         BookSortField = "rating"
+	BookSortByNewest         BookSortField = "newest"
+)
+
+// BookSortDTO -- порядок сортировки книг. Desc меняет направление сортировки поля по умолчанию
+// (по возрастанию для всех полей, кроме рейтинга и новизны)
+type BookSortDTO struct {
+	Field BookSortField
+	Desc  bool
+}
+
+type FacetBucketDTO struct {
+	Value string
+	Count int64
+}
+
+type DecadeBucketDTO struct {
+	Decade uint
+	Count  int64
+}
+
+// BookFacetsDTO -- количество найденных книг в разрезе жанра, языка, редкости и десятилетия издания
+type BookFacetsDTO struct {
+	Total     int64
+	Genres    []FacetBucketDTO
+	Languages []FacetBucketDTO
+	Rarities  []FacetBucketDTO
+	Decades   []DecadeBucketDTO
+}
+
+// BookPageDTO -- страница книг вместе с общим количеством книг, подходящих под фильтр
+type BookPageDTO struct {
+	Books   []*models.BookModel
+	Total   int64
+	HasMore bool
+}
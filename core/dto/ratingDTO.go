@@ -0,0 +1,37 @@
+package dto
+
+import (
+	"github.com/google/uuid"
+	"github.com/nikitalystsev/BookSmart-services/core/models"
+)
+
+// RatingStatsDTO -- сводка оценок книги. Histogram[i] -- количество оценок i+1
+type RatingStatsDTO struct {
+	BookID    uuid.UUID
+	Avg       float64
+	Count     int64
+	Histogram [5]int64
+}
+
+type ReviewSort string
+
+const (
+	ReviewSortNewest  ReviewSort = "newest"
+	ReviewSortHighest ReviewSort = "highest"
+	ReviewSortLowest  ReviewSort = "lowest"
+)
+
+// ReviewFeedParamsDTO -- параметры ленты отзывов книги. Пустой Sort означает сортировку по новизне,
+// пустой After -- первую страницу
+type ReviewFeedParamsDTO struct {
+	Sort           ReviewSort
+	Limit          uint
+	After          string
+	WithReviewOnly bool
+}
+
+// ReviewPageDTO -- страница отзывов. Пустой Next означает, что страниц больше нет
+type ReviewPageDTO struct {
+	Ratings []*models.RatingModel
+	Next    string
+}
@@ -0,0 +1,16 @@
+package dto
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// RefreshSessionDTO -- активный refresh-токен читателя. ID -- SHA-256 токена в hex, сам токен не раскрывается.
+// Нулевой ExpiresAt означает токен без срока
+type RefreshSessionDTO struct {
+	ID        string
+	ReaderID  uuid.UUID
+	Device    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
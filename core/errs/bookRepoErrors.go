@@ -0,0 +1,14 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nikitalystsev/BookSmart-services/errs"
+)
+
+var (
+	ErrInvalidBookSort     = errors.New("[!] bookRepo error! Invalid book sort")
+	ErrInvalidBookCursor   = errors.New("[!] bookRepo error! Invalid book cursor")
+	ErrBookNoCopiesLeft    = fmt.Errorf("[!] bookRepo error! No copies left: %w", errs.ErrBookNoCopiesNum)
+	ErrBookVersionConflict = fmt.Errorf("[!] bookRepo error! Book version conflict: %w", ErrVersionConflict)
+)
@@ -0,0 +1,7 @@
+package errs
+
+import "fmt"
+
+var (
+	ErrLibCardVersionConflict = fmt.Errorf("[!] libCardRepo error! LibCard version conflict: %w", ErrVersionConflict)
+)
@@ -0,0 +1,14 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nikitalystsev/BookSmart-services/errs"
+)
+
+var (
+	ErrInvalidReviewSort   = errors.New("[!] ratingRepo error! Invalid review sort")
+	ErrInvalidReviewCursor = errors.New("[!] ratingRepo error! Invalid review cursor")
+	ErrInvalidReviewStatus = errors.New("[!] ratingRepo error! Invalid review moderation status")
+	ErrRatingDuplicate     = fmt.Errorf("[!] ratingRepo error! Reader already rated this book: %w: %w", errs.ErrRatingAlreadyExist, ErrDuplicateKey)
+)
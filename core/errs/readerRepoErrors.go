@@ -0,0 +1,16 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nikitalystsev/BookSmart-services/errs"
+)
+
+var (
+	ErrFavoriteDoesNotExists = errors.New("[!] readerRepo error! Book is not in favorites")
+	ErrFavoriteDuplicate     = fmt.Errorf("[!] readerRepo error! Book already in favorites: %w: %w", errs.ErrBookAlreadyIsFavorite, ErrDuplicateKey)
+
+	ErrRefreshTokenDoesNotExists = fmt.Errorf("[!] readerRepo error! Refresh token does not exist: %w", errs.ErrReaderDoesNotExists)
+	ErrRefreshTokenReused        = errors.New("[!] readerRepo error! Rotated refresh token reused, all reader sessions revoked")
+	ErrInvalidRefreshTokenTTL    = errors.New("[!] readerRepo error! Refresh token ttl must not be negative")
+)
@@ -0,0 +1,12 @@
+package errs
+
+import "errors"
+
+var (
+	ErrVersionConflict = errors.New("[!] repo error! Document was modified by another writer")
+	ErrDuplicateKey    = errors.New("[!] repo error! Duplicate key")
+	ErrWriteConflict   = errors.New("[!] repo error! Write conflict, operation can be retried")
+	ErrNetwork         = errors.New("[!] repo error! Network error")
+	ErrTimeout         = errors.New("[!] repo error! Operation timed out")
+	ErrCanceled        = errors.New("[!] repo error! Operation canceled")
+)
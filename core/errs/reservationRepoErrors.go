@@ -0,0 +1,7 @@
+package errs
+
+import "fmt"
+
+var (
+	ErrReservationVersionConflict = fmt.Errorf("[!] reservationRepo error! Reservation version conflict: %w", ErrVersionConflict)
+)
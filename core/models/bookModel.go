@@ -1,6 +1,9 @@
 package models
 
-import "github.com/google/uuid"
+import (
+	"github.com/google/uuid"
+	"time"
+)
 
 type BookModel struct {
 	ID             uuid.UUID `bson:"_id"`
@@ -13,4 +16,9 @@ type BookModel struct {
 	PublishingYear uint      `bson:"publishing_year"`
 	Language       string    `bson:"language"`
 	AgeLimit       uint      `bson:"age_limit"`
+	Version        int64     `bson:"version"`
+	CreatedAt      time.Time `bson:"created_at"`
+	RatingSum      int64     `bson:"rating_sum"`
+	RatingCount    int64     `bson:"rating_count"`
+	RatingAvg      float64   `bson:"rating_avg"`
 }
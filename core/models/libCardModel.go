@@ -12,4 +12,5 @@ type LibCardModel struct {
 	Validity     int       `bson:"validity"`
 	IssueDate    time.Time `bson:"issue_date"`
 	ActionStatus bool      `bson:"action_status"`
+	Version      int64     `bson:"version"`
 }
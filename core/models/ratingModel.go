@@ -1,11 +1,25 @@
 package models
 
-import "github.com/google/uuid"
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	ReviewPending  = "Pending"
+	ReviewApproved = "Approved"
+	ReviewRejected = "Rejected"
+)
 
 type RatingModel struct {
-	ID       uuid.UUID `bson:"_id"`
-	ReaderID uuid.UUID `bson:"reader_id"`
-	BookID   uuid.UUID `bson:"book_id"`
-	Review   string    `bson:"review"`
-	Rating   int       `bson:"rating"`
+	ID               uuid.UUID  `bson:"_id"`
+	ReaderID         uuid.UUID  `bson:"reader_id"`
+	BookID           uuid.UUID  `bson:"book_id"`
+	Review           string     `bson:"review"`
+	Rating           int        `bson:"rating"`
+	CreatedAt        time.Time  `bson:"created_at"`
+	Status           string     `bson:"status"`
+	ModeratorID      *uuid.UUID `bson:"moderator_id,omitempty"`
+	ModeratedAt      *time.Time `bson:"moderated_at,omitempty"`
+	ModerationReason string     `bson:"moderation_reason,omitempty"`
 }
@@ -12,4 +12,5 @@ type ReservationModel struct {
 	IssueDate  time.Time `bson:"issue_date"`
 	ReturnDate time.Time `bson:"return_date"`
 	State      string    `bson:"state"`
+	Version    int64     `bson:"version"`
 }
@@ -0,0 +1,149 @@
+package repoMongo
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sync"
+	"time"
+)
+
+// DefaultHealthTimeout -- срок на проверку одной зависимости
+const DefaultHealthTimeout = 2 * time.Second
+
+// DependencyHealth -- результат проверки одной зависимости
+type DependencyHealth struct {
+	Name      string  `json:"name"`
+	Healthy   bool    `json:"healthy"`
+	LatencyMs float64 `json:"latency_ms"`
+	// ReplicaSet и Primary заполняются только для MongoDB, запущенной как набор реплик
+	ReplicaSet string `json:"replica_set,omitempty"`
+	Primary    string `json:"primary,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// HealthReport -- результат проверки всех зависимостей, пригодный для сериализации в ответ /healthz
+type HealthReport struct {
+	Healthy      bool               `json:"healthy"`
+	CheckedAt    time.Time          `json:"checked_at"`
+	Dependencies []DependencyHealth `json:"dependencies"`
+}
+
+// HealthChecker проверяет доступность MongoDB и Redis
+type HealthChecker struct {
+	mongoClient  *mongo.Client
+	redisClient  *redis.Client
+	mongoTimeout time.Duration
+	redisTimeout time.Duration
+}
+
+// HealthOption -- настройка HealthChecker
+type HealthOption func(*HealthChecker)
+
+func WithMongoHealthTimeout(timeout time.Duration) HealthOption {
+	return func(hc *HealthChecker) {
+		hc.mongoTimeout = timeout
+	}
+}
+
+func WithRedisHealthTimeout(timeout time.Duration) HealthOption {
+	return func(hc *HealthChecker) {
+		hc.redisTimeout = timeout
+	}
+}
+
+// NewHealthChecker создает проверку зависимостей. Нулевой redisClient означает, что Redis не проверяется
+func NewHealthChecker(mongoClient *mongo.Client, redisClient *redis.Client, opts ...HealthOption) *HealthChecker {
+	hc := &HealthChecker{
+		mongoClient:  mongoClient,
+		redisClient:  redisClient,
+		mongoTimeout: DefaultHealthTimeout,
+		redisTimeout: DefaultHealthTimeout,
+	}
+	for _, opt := range opts {
+		opt(hc)
+	}
+
+	return hc
+}
+
+// Check параллельно проверяет все зависимости. Отчет считается здоровым, только если здоровы все зависимости
+func (hc *HealthChecker) Check(ctx context.Context) *HealthReport {
+	checks := []func(context.Context) DependencyHealth{hc.checkMongo}
+	if hc.redisClient != nil {
+		checks = append(checks, hc.checkRedis)
+	}
+
+	report := &HealthReport{Healthy: true, CheckedAt: time.Now(), Dependencies: make([]DependencyHealth, len(checks))}
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check func(context.Context) DependencyHealth) {
+			defer wg.Done()
+			report.Dependencies[i] = check(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, dependency := range report.Dependencies {
+		report.Healthy = report.Healthy && dependency.Healthy
+	}
+
+	return report
+}
+
+type helloResult struct {
+	SetName string `bson:"setName"`
+	Primary string `bson:"primary"`
+}
+
+func (hc *HealthChecker) checkMongo(ctx context.Context) DependencyHealth {
+	ctx, cancel := context.WithTimeout(ctx, hc.mongoTimeout)
+	defer cancel()
+
+	health := DependencyHealth{Name: "mongodb"}
+
+	start := time.Now()
+	var hello helloResult
+	err := hc.mongoClient.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	health.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		health.Error = fmt.Sprintf("error running hello: %v", err)
+		return health
+	}
+
+	health.Healthy = true
+	if hello.SetName != "" {
+		health.ReplicaSet = hello.SetName
+		health.Primary = hello.Primary
+		// без primary набор реплик не принимает записи
+		if hello.Primary == "" {
+			health.Healthy = false
+			health.Error = "replica set has no primary"
+		}
+	}
+
+	return health
+}
+
+func (hc *HealthChecker) checkRedis(ctx context.Context) DependencyHealth {
+	ctx, cancel := context.WithTimeout(ctx, hc.redisTimeout)
+	defer cancel()
+
+	health := DependencyHealth{Name: "redis"}
+
+	start := time.Now()
+	err := hc.redisClient.Ping(ctx).Err()
+	health.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		health.Error = fmt.Sprintf("error pinging redis: %v", err)
+		return health
+	}
+
+	health.Healthy = true
+
+	return health
+}
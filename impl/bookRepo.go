@@ -3,9 +3,11 @@ package impl
 import (
 	"context"
 	"errors"
-	"fmt"
 	"github.com/google/uuid"
+	repodto "github.com/nikitalystsev/BookSmart-repo-mongo/core/dto"
+	repoerrs "github.com/nikitalystsev/BookSmart-repo-mongo/core/errs"
 	repomodels "github.com/nikitalystsev/BookSmart-repo-mongo/core/models"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/pkg/transact"
 	"github.com/nikitalystsev/BookSmart-services/core/dto"
 	"github.com/nikitalystsev/BookSmart-services/core/models"
 	"github.com/nikitalystsev/BookSmart-services/errs"
@@ -14,6 +16,8 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"regexp"
+	"time"
 )
 
 type BookRepo struct {
@@ -21,31 +25,44 @@ type BookRepo struct {
 	logger *logrus.Entry
 }
 
-func NewBookRepo(db *mongo.Database, logger *logrus.Entry) intfRepo.IBookRepo {
+var _ intfRepo.IBookRepo = (*BookRepo)(nil)
+
+func NewBookRepo(db *mongo.Database, logger *logrus.Entry) *BookRepo {
 	return &BookRepo{db: db.Collection("book"), logger: logger}
 }
 
-func (br *BookRepo) Create(ctx context.Context, book *models.BookModel) error {
-	br.logger.Infof("inserting book with ID: %s", book.ID)
+func (br *BookRepo) Create(ctx context.Context, book *models.BookModel) (err error) {
+	ctx, span := startSpan(ctx, "book", "Create")
+	defer func() { span.end(err) }()
+
+	br.logger.Debugf("inserting book with ID: %s", book.ID)
+
+	ctx = transact.SessionContext(ctx)
+
+	repoBook := br.convertToRepoBookModel(book)
+	repoBook.CreatedAt = time.Now()
 
-	_, err := br.db.InsertOne(ctx, br.convertToRepoBookModel(book))
+	_, err = br.db.InsertOne(ctx, repoBook)
 	if err != nil {
-		br.logger.Errorf("error inserting book: %v", err)
-		return err
+		return logRepoError(br.logger, "error inserting book", err)
 	}
 
-	br.logger.Infof("inserted book with ID: %s", book.ID)
+	br.logger.Debugf("inserted book with ID: %s", book.ID)
 
 	return nil
 }
 
-func (br *BookRepo) GetByID(ctx context.Context, ID uuid.UUID) (*models.BookModel, error) {
-	br.logger.Infof("find book with ID: %s", ID)
+func (br *BookRepo) GetByID(ctx context.Context, ID uuid.UUID) (_ *models.BookModel, err error) {
+	ctx, span := startSpan(ctx, "book", "GetByID")
+	defer func() { span.end(err) }()
+
+	br.logger.Debugf("find book with ID: %s", ID)
+
+	ctx = transact.SessionContext(ctx)
 
 	one := br.db.FindOne(ctx, bson.M{"_id": ID})
 	if one.Err() != nil && !errors.Is(one.Err(), mongo.ErrNoDocuments) {
-		br.logger.Errorf("error find book with ID: %v", one.Err())
-		return nil, one.Err()
+		return nil, logRepoError(br.logger, "error find book with ID", one.Err())
 	}
 	if one.Err() != nil && errors.Is(one.Err(), mongo.ErrNoDocuments) {
 		br.logger.Warnf("book with this ID not found %s", ID)
@@ -54,22 +71,25 @@ func (br *BookRepo) GetByID(ctx context.Context, ID uuid.UUID) (*models.BookMode
 
 	var book repomodels.BookModel
 	if err := one.Decode(&book); err != nil {
-		br.logger.Errorf("error decoding book: %v", err)
-		return nil, err
+		return nil, logRepoError(br.logger, "error decoding book", err)
 	}
 
-	br.logger.Infof("found book with ID: %s", ID)
+	br.logger.Debugf("found book with ID: %s", ID)
 
-	return br.convertToBookModel(&book), nil
+	return convertToBookModel(&book), nil
 }
 
-func (br *BookRepo) GetByTitle(ctx context.Context, title string) (*models.BookModel, error) {
-	br.logger.Infof("find book by title: %s", title)
+func (br *BookRepo) GetByTitle(ctx context.Context, title string) (_ *models.BookModel, err error) {
+	ctx, span := startSpan(ctx, "book", "GetByTitle")
+	defer func() { span.end(err) }()
+
+	br.logger.Debugf("find book by title: %s", title)
+
+	ctx = transact.SessionContext(ctx)
 
 	one := br.db.FindOne(ctx, bson.M{"title": title})
 	if one.Err() != nil && !errors.Is(one.Err(), mongo.ErrNoDocuments) {
-		br.logger.Errorf("error find book with ID: %v", one.Err())
-		return nil, one.Err()
+		return nil, logRepoError(br.logger, "error find book with ID", one.Err())
 	}
 	if one.Err() != nil && errors.Is(one.Err(), mongo.ErrNoDocuments) {
 		br.logger.Warnf("book with this title not found: %s", title)
@@ -78,22 +98,25 @@ func (br *BookRepo) GetByTitle(ctx context.Context, title string) (*models.BookM
 
 	var book repomodels.BookModel
 	if err := one.Decode(&book); err != nil {
-		br.logger.Errorf("error decoding book: %v", err)
-		return nil, err
+		return nil, logRepoError(br.logger, "error decoding book", err)
 	}
 
-	br.logger.Infof("found book with title: %s", title)
+	br.logger.Debugf("found book with title: %s", title)
 
-	return br.convertToBookModel(&book), nil
+	return convertToBookModel(&book), nil
 }
 
-func (br *BookRepo) Delete(ctx context.Context, ID uuid.UUID) error {
-	br.logger.Infof("deleting book with ID: %s", ID)
+func (br *BookRepo) Delete(ctx context.Context, ID uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "book", "Delete")
+	defer func() { span.end(err) }()
+
+	br.logger.Debugf("deleting book with ID: %s", ID)
+
+	ctx = transact.SessionContext(ctx)
 
 	one, err := br.db.DeleteOne(ctx, bson.M{"_id": ID})
 	if err != nil {
-		br.logger.Errorf("error deleting book: %v", err)
-		return err
+		return logRepoError(br.logger, "error deleting book", err)
 	}
 
 	if one.DeletedCount == 0 {
@@ -101,15 +124,105 @@ func (br *BookRepo) Delete(ctx context.Context, ID uuid.UUID) error {
 		return errs.ErrBookDoesNotExists
 	}
 
-	br.logger.Infof("deleted book with ID: %s", ID)
+	br.logger.Debugf("deleted book with ID: %s", ID)
+
+	return nil
+}
+
+// Update обновляет книгу без проверки версии. Для оптимистичной блокировки -- GetByIDWithVersion и UpdateWithVersion
+func (br *BookRepo) Update(ctx context.Context, book *models.BookModel) (err error) {
+	ctx, span := startSpan(ctx, "book", "Update")
+	defer func() { span.end(err) }()
+
+	br.logger.Debugf("updating book with ID: %s", book.ID)
+
+	ctx = transact.SessionContext(ctx)
+
+	one, err := br.db.UpdateOne(ctx, bson.M{"_id": book.ID}, br.getUpdateData(book))
+	if err != nil {
+		return logRepoError(br.logger, "error updating book", err)
+	}
+
+	if one.MatchedCount == 0 {
+		br.logger.Warnf("book with this ID not found %s", book.ID)
+		return errs.ErrBookDoesNotExists
+	}
+
+	br.logger.Debugf("updated book with ID: %s", book.ID)
 
 	return nil
 }
 
-func (br *BookRepo) Update(ctx context.Context, book *models.BookModel) error {
-	br.logger.Infof("updating book with ID: %s", book.ID)
+// GetByIDWithVersion возвращает книгу вместе с ее текущей версией для последующего UpdateWithVersion
+func (br *BookRepo) GetByIDWithVersion(ctx context.Context, ID uuid.UUID) (_ *models.BookModel, _ int64, err error) {
+	ctx, span := startSpan(ctx, "book", "GetByIDWithVersion")
+	defer func() { span.end(err) }()
+
+	br.logger.Debugf("find book with version by ID: %s", ID)
+
+	ctx = transact.SessionContext(ctx)
+
+	one := br.db.FindOne(ctx, bson.M{"_id": ID})
+	if one.Err() != nil && !errors.Is(one.Err(), mongo.ErrNoDocuments) {
+		return nil, 0, logRepoError(br.logger, "error find book with ID", one.Err())
+	}
+	if one.Err() != nil && errors.Is(one.Err(), mongo.ErrNoDocuments) {
+		br.logger.Warnf("book with this ID not found %s", ID)
+		return nil, 0, errs.ErrBookDoesNotExists
+	}
+
+	var book repomodels.BookModel
+	if err := one.Decode(&book); err != nil {
+		return nil, 0, logRepoError(br.logger, "error decoding book", err)
+	}
+
+	br.logger.Debugf("found book with ID: %s, version: %d", ID, book.Version)
+
+	return convertToBookModel(&book), book.Version, nil
+}
+
+// UpdateWithVersion обновляет книгу, только если ее версия в БД равна version.
+// Если книгу уже изменил кто-то другой, возвращается repoerrs.ErrBookVersionConflict
+func (br *BookRepo) UpdateWithVersion(ctx context.Context, book *models.BookModel, version int64) (err error) {
+	ctx, span := startSpan(ctx, "book", "UpdateWithVersion")
+	defer func() { span.end(err) }()
+
+	br.logger.Debugf("updating book with ID: %s, expected version: %d", book.ID, version)
+
+	ctx = transact.SessionContext(ctx)
+
+	one, err := br.db.UpdateOne(ctx, getVersionFilter(book.ID, version), br.getUpdateData(book))
+	if err != nil {
+		return logRepoError(br.logger, "error updating book", err)
+	}
+
+	if one.MatchedCount == 0 {
+		return br.checkVersionConflictReason(ctx, book.ID)
+	}
+
+	br.logger.Debugf("updated book with ID: %s", book.ID)
+
+	return nil
+}
+
+func (br *BookRepo) checkVersionConflictReason(ctx context.Context, bookID uuid.UUID) error {
+	count, err := br.db.CountDocuments(ctx, bson.M{"_id": bookID})
+	if err != nil {
+		return logRepoError(br.logger, "error find book with ID", err)
+	}
+
+	if count == 0 {
+		br.logger.Warnf("book with this ID not found %s", bookID)
+		return errs.ErrBookDoesNotExists
+	}
+
+	br.logger.Warnf("book with ID %s was modified by another writer", bookID)
 
-	updateData := bson.M{
+	return repoerrs.ErrBookVersionConflict
+}
+
+func (br *BookRepo) getUpdateData(book *models.BookModel) bson.M {
+	return bson.M{
 		"$set": bson.M{
 			"title":           book.Title,
 			"author":          book.Author,
@@ -121,101 +234,566 @@ func (br *BookRepo) Update(ctx context.Context, book *models.BookModel) error {
 			"language":        book.Language,
 			"age_limit":       book.AgeLimit,
 		},
+		"$inc": bson.M{"version": 1},
 	}
+}
+
+// DecrementCopies атомарно уменьшает copies_number на 1, если есть свободные экземпляры
+func (br *BookRepo) DecrementCopies(ctx context.Context, bookID uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "book", "DecrementCopies")
+	defer func() { span.end(err) }()
 
-	one, err := br.db.UpdateOne(ctx, bson.M{"_id": book.ID}, updateData)
+	br.logger.Debugf("decrementing copies of book with ID: %s", bookID)
+
+	ctx = transact.SessionContext(ctx)
+
+	filter := bson.M{"_id": bookID, "copies_number": bson.M{"$gt": 0}}
+	update := bson.M{"$inc": bson.M{"copies_number": -1, "version": 1}}
+
+	one, err := br.db.UpdateOne(ctx, filter, update)
 	if err != nil {
-		br.logger.Errorf("error updating book: %v", err)
-		return err
+		return logRepoError(br.logger, "error decrementing book copies", err)
 	}
 
 	if one.MatchedCount == 0 {
-		br.logger.Warnf("book with this ID not found %s", book.ID)
+		return br.checkNoCopiesReason(ctx, bookID)
+	}
+
+	br.logger.Debugf("decremented copies of book with ID: %s", bookID)
+
+	return nil
+}
+
+// IncrementCopies атомарно увеличивает copies_number на 1
+func (br *BookRepo) IncrementCopies(ctx context.Context, bookID uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "book", "IncrementCopies")
+	defer func() { span.end(err) }()
+
+	br.logger.Debugf("incrementing copies of book with ID: %s", bookID)
+
+	ctx = transact.SessionContext(ctx)
+
+	one, err := br.db.UpdateOne(ctx, bson.M{"_id": bookID}, bson.M{"$inc": bson.M{"copies_number": 1, "version": 1}})
+	if err != nil {
+		return logRepoError(br.logger, "error incrementing book copies", err)
+	}
+
+	if one.MatchedCount == 0 {
+		br.logger.Warnf("book with this ID not found %s", bookID)
 		return errs.ErrBookDoesNotExists
 	}
 
-	br.logger.Infof("updated book with ID: %s", book.ID)
+	br.logger.Debugf("incremented copies of book with ID: %s", bookID)
 
 	return nil
 }
 
-func (br *BookRepo) GetByParams(ctx context.Context, params *dto.BookParamsDTO) ([]*models.BookModel, error) {
-	br.logger.Printf("selecting books with params")
+func (br *BookRepo) checkNoCopiesReason(ctx context.Context, bookID uuid.UUID) error {
+	count, err := br.db.CountDocuments(ctx, bson.M{"_id": bookID})
+	if err != nil {
+		return logRepoError(br.logger, "error find book with ID", err)
+	}
 
-	filter := br.getFilterByParams(params)
+	if count == 0 {
+		br.logger.Warnf("book with this ID not found %s", bookID)
+		return errs.ErrBookDoesNotExists
+	}
 
-	findOptions := options.Find()
-	findOptions.SetLimit(int64(params.Limit))
-	findOptions.SetSkip(int64(params.Offset))
+	br.logger.Warnf("book with ID %s has no copies left", bookID)
 
-	cursor, err := br.db.Find(ctx, filter, findOptions)
+	return repoerrs.ErrBookNoCopiesLeft
+}
+
+func (br *BookRepo) GetByParams(ctx context.Context, params *dto.BookParamsDTO) (_ []*models.BookModel, err error) {
+	ctx, span := startSpan(ctx, "book", "GetByParams")
+	defer func() { span.end(err) }()
+
+	return br.getByParamsSorted(ctx, &repodto.BookParamsDTO{BookParamsDTO: *params}, nil)
+}
+
+// GetByParamsSorted возвращает страницу книг, отсортированную по sort (по названию, если sort не задан).
+// Для стабильной пагинации при равных значениях книги упорядочиваются по _id
+func (br *BookRepo) GetByParamsSorted(ctx context.Context, params *repodto.BookParamsDTO, sort *repodto.BookSortDTO) (_ []*models.BookModel, err error) {
+	ctx, span := startSpan(ctx, "book", "GetByParamsSorted")
+	defer func() { span.end(err) }()
+
+	return br.getByParamsSorted(ctx, params, sort)
+}
+
+// getByParamsSorted -- общая часть GetByParams и GetByParamsSorted без собственного span
+func (br *BookRepo) getByParamsSorted(ctx context.Context, params *repodto.BookParamsDTO, sort *repodto.BookSortDTO) ([]*models.BookModel, error) {
+	br.logger.Debugf("selecting books with params")
+
+	ctx = transact.SessionContext(ctx)
+
+	if sort == nil {
+		sort = &defaultBookSort
+	}
+
+	sortData, err := br.getSort(sort)
 	if err != nil {
-		br.logger.Printf("error selecting books with params: %v", err)
+		br.logger.Warnf("invalid book sort: %v", sort)
 		return nil, err
 	}
+
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: br.getFilterByParams(params)}}}
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: sortData}})
+	if params.Offset > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: int64(params.Offset)}})
+	}
+	if params.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: int64(params.Limit)}})
+	}
+
+	cursor, err := br.db.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, logRepoError(br.logger, "error selecting books with params", err)
+	}
 	defer func(cursor *mongo.Cursor, ctx context.Context) {
-		err = cursor.Close(ctx)
-		if err != nil {
-			fmt.Println("error close cursor")
+		if err := cursor.Close(ctx); err != nil {
+			br.logger.Warnf("error closing cursor: %v", err)
 		}
 	}(cursor, ctx)
 
 	var coreBooks []*repomodels.BookModel
 	if err = cursor.All(ctx, &coreBooks); err != nil {
-		br.logger.Printf("error decoding books: %v", err)
+		return nil, logRepoError(br.logger, "error decoding books", err)
+	}
+
+	if len(coreBooks) == 0 {
+		br.logger.Warnf("books not found with these params")
+		return nil, errs.ErrBookDoesNotExists
+	}
+
+	br.logger.Debugf("found %d books", len(coreBooks))
+
+	books := make([]*models.BookModel, len(coreBooks))
+	for i, book := range coreBooks {
+		books[i] = convertToBookModel(book)
+	}
+
+	return books, nil
+}
+
+type bookPageResult struct {
+	Items []*repomodels.BookModel `bson:"items"`
+	Total []struct {
+		Count int64 `bson:"count"`
+	} `bson:"total"`
+}
+
+const (
+	defaultBooksPageLimit = 20
+	maxBooksPageLimit     = 100
+)
+
+// getPageLimit -- размер страницы: нулевой limit означает defaultBooksPageLimit, больший maxBooksPageLimit урезается до него
+func (br *BookRepo) getPageLimit(limit uint) uint {
+	if limit == 0 {
+		return defaultBooksPageLimit
+	}
+
+	return min(limit, maxBooksPageLimit)
+}
+
+// GetPageByParams возвращает страницу книг вместе с общим количеством подходящих под params книг.
+// Нулевой params.Limit означает defaultBooksPageLimit, больший maxBooksPageLimit урезается до него.
+// Пустая страница не считается ошибкой
+func (br *BookRepo) GetPageByParams(ctx context.Context, params *repodto.BookParamsDTO, sort *repodto.BookSortDTO) (_ *repodto.BookPageDTO, err error) {
+	ctx, span := startSpan(ctx, "book", "GetPageByParams")
+	defer func() { span.end(err) }()
+
+	br.logger.Debugf("selecting books page with params")
+
+	ctx = transact.SessionContext(ctx)
+
+	if sort == nil {
+		sort = &defaultBookSort
+	}
+
+	sortData, err := br.getSort(sort)
+	if err != nil {
+		br.logger.Warnf("invalid book sort: %v", sort)
 		return nil, err
 	}
 
+	limit := br.getPageLimit(params.Limit)
+
+	var items bson.A
+	if params.Offset > 0 {
+		items = append(items, bson.M{"$skip": int64(params.Offset)})
+	}
+	items = append(items, bson.M{"$limit": int64(limit)})
+
+	// сортировка до $facet может использовать индекс, внутри $facet -- нет
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: br.getFilterByParams(params)}},
+		{{Key: "$sort", Value: sortData}},
+		{{Key: "$facet", Value: bson.M{
+			"items": items,
+			"total": bson.A{bson.M{"$count": "count"}},
+		}}},
+	}
+
+	cursor, err := br.db.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, logRepoError(br.logger, "error selecting books page", err)
+	}
+	defer func(cursor *mongo.Cursor, ctx context.Context) {
+		if err := cursor.Close(ctx); err != nil {
+			br.logger.Warnf("error closing cursor: %v", err)
+		}
+	}(cursor, ctx)
+
+	var results []bookPageResult
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, logRepoError(br.logger, "error decoding books page", err)
+	}
+
+	page := &repodto.BookPageDTO{Books: []*models.BookModel{}}
+	if len(results) == 0 {
+		return page, nil
+	}
+
+	result := results[0]
+	if len(result.Total) > 0 {
+		page.Total = result.Total[0].Count
+	}
+	page.Books = make([]*models.BookModel, len(result.Items))
+	for i, book := range result.Items {
+		page.Books[i] = convertToBookModel(book)
+	}
+	page.HasMore = int64(max(params.Offset, 0)+len(page.Books)) < page.Total
+
+	br.logger.Debugf("found %d books of %d", len(page.Books), page.Total)
+
+	return page, nil
+}
+
+// GetByParamsAfter возвращает страницу книг, следующую за after, и непрозрачный токен для запроса следующей страницы.
+// Пустой after означает первую страницу, пустой возвращаемый токен -- что страниц больше нет.
+// В отличие от GetByParams, params.Offset не используется, а размер страницы ограничен как в GetPageByParams
+func (br *BookRepo) GetByParamsAfter(ctx context.Context, params *repodto.BookParamsDTO, sort *repodto.BookSortDTO, after string) (_ []*models.BookModel, _ string, err error) {
+	ctx, span := startSpan(ctx, "book", "GetByParamsAfter")
+	defer func() { span.end(err) }()
+
+	br.logger.Debugf("selecting books with params after cursor")
+
+	ctx = transact.SessionContext(ctx)
+
+	if sort == nil {
+		sort = &defaultBookSort
+	}
+
+	sortData, err := br.getSort(sort)
+	if err != nil {
+		br.logger.Warnf("invalid book sort: %v", sort)
+		return nil, "", err
+	}
+
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: br.getFilterByParams(params)}}}
+	if after != "" {
+		keyset, ok := getKeysetFilter(after, br.getSortName(sort), sortData)
+		if !ok {
+			br.logger.Warnf("invalid book cursor: %s", after)
+			return nil, "", repoerrs.ErrInvalidBookCursor
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: keyset}})
+	}
+	limit := br.getPageLimit(params.Limit)
+	// лишний документ показывает, есть ли следующая страница
+	pipeline = append(pipeline,
+		bson.D{{Key: "$sort", Value: sortData}},
+		bson.D{{Key: "$limit", Value: int64(limit) + 1}},
+	)
+
+	cursor, err := br.db.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, "", logRepoError(br.logger, "error selecting books after cursor", err)
+	}
+	defer func(cursor *mongo.Cursor, ctx context.Context) {
+		if err := cursor.Close(ctx); err != nil {
+			br.logger.Warnf("error closing cursor: %v", err)
+		}
+	}(cursor, ctx)
+
+	var books []*models.BookModel
+	var last bson.Raw
+	hasMore := false
+	for cursor.Next(ctx) {
+		if uint(len(books)) == limit {
+			hasMore = true
+			break
+		}
+
+		var book repomodels.BookModel
+		if err = cursor.Decode(&book); err != nil {
+			return nil, "", logRepoError(br.logger, "error decoding book", err)
+		}
+		books = append(books, convertToBookModel(&book))
+		last = append(last[:0], cursor.Current...)
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, "", logRepoError(br.logger, "error selecting books after cursor", err)
+	}
+
+	if len(books) == 0 {
+		br.logger.Warnf("books not found with these params after cursor")
+		return nil, "", errs.ErrBookDoesNotExists
+	}
+
+	next := ""
+	if hasMore {
+		if next, err = encodeKeysetCursor(br.getSortName(sort), last, sortData); err != nil {
+			return nil, "", logRepoError(br.logger, "error encoding book cursor", err)
+		}
+	}
+
+	br.logger.Debugf("found %d books after cursor", len(books))
+
+	return books, next, nil
+}
+
+type facetBucket struct {
+	Value string `bson:"_id"`
+	Count int64  `bson:"count"`
+}
+
+type bookFacetsResult struct {
+	Total []struct {
+		Count int64 `bson:"count"`
+	} `bson:"total"`
+	Genres    []facetBucket `bson:"genres"`
+	Languages []facetBucket `bson:"languages"`
+	Rarities  []facetBucket `bson:"rarities"`
+	Decades   []struct {
+		Decade uint  `bson:"_id"`
+		Count  int64 `bson:"count"`
+	} `bson:"decades"`
+}
+
+// Facets возвращает количество книг, подходящих под params, по жанрам, языкам, редкости и десятилетиям издания
+// за один запрос. params.Limit и params.Offset не учитываются
+func (br *BookRepo) Facets(ctx context.Context, params *repodto.BookParamsDTO) (_ *repodto.BookFacetsDTO, err error) {
+	ctx, span := startSpan(ctx, "book", "Facets")
+	defer func() { span.end(err) }()
+
+	br.logger.Debugf("counting book facets with params")
+
+	ctx = transact.SessionContext(ctx)
+
+	decade := bson.M{"$multiply": bson.A{bson.M{"$floor": bson.M{"$divide": bson.A{"$publishing_year", 10}}}, 10}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: br.getFilterByParams(params)}},
+		{{Key: "$facet", Value: bson.M{
+			"total":     bson.A{bson.M{"$count": "count"}},
+			"genres":    bson.A{bson.M{"$sortByCount": "$genre"}},
+			"languages": bson.A{bson.M{"$sortByCount": "$language"}},
+			"rarities":  bson.A{bson.M{"$sortByCount": "$rarity"}},
+			"decades": bson.A{
+				bson.M{"$group": bson.M{"_id": decade, "count": bson.M{"$sum": 1}}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+			},
+		}}},
+	}
+
+	cursor, err := br.db.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, logRepoError(br.logger, "error counting book facets", err)
+	}
+	defer func(cursor *mongo.Cursor, ctx context.Context) {
+		if err := cursor.Close(ctx); err != nil {
+			br.logger.Warnf("error closing cursor: %v", err)
+		}
+	}(cursor, ctx)
+
+	var results []bookFacetsResult
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, logRepoError(br.logger, "error decoding book facets", err)
+	}
+
+	facets := &repodto.BookFacetsDTO{}
+	if len(results) == 0 {
+		return facets, nil
+	}
+
+	result := results[0]
+	if len(result.Total) > 0 {
+		facets.Total = result.Total[0].Count
+	}
+	facets.Genres = br.convertToFacetBuckets(result.Genres)
+	facets.Languages = br.convertToFacetBuckets(result.Languages)
+	facets.Rarities = br.convertToFacetBuckets(result.Rarities)
+	facets.Decades = make([]repodto.DecadeBucketDTO, len(result.Decades))
+	for i, bucket := range result.Decades {
+		facets.Decades[i] = repodto.DecadeBucketDTO{Decade: bucket.Decade, Count: bucket.Count}
+	}
+
+	br.logger.Debugf("counted book facets, total: %d", facets.Total)
+
+	return facets, nil
+}
+
+// Search выполняет полнотекстовый поиск по названию, автору, издательству и жанру с учетом фильтров params.
+// Результаты отсортированы по релевантности
+func (br *BookRepo) Search(ctx context.Context, query string, params *repodto.BookParamsDTO) (_ []*models.BookModel, err error) {
+	ctx, span := startSpan(ctx, "book", "Search")
+	defer func() { span.end(err) }()
+
+	br.logger.Debugf("searching books by query: %s", query)
+
+	ctx = transact.SessionContext(ctx)
+
+	filter := br.getFilterByParams(params)
+	filter["$text"] = bson.M{"$search": query}
+
+	score := bson.M{"score": bson.M{"$meta": "textScore"}}
+	findOptions := options.Find().
+		SetProjection(score).
+		SetSort(bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(params.Limit)).
+		SetSkip(int64(params.Offset))
+
+	cursor, err := br.db.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, logRepoError(br.logger, "error searching books", err)
+	}
+	defer func(cursor *mongo.Cursor, ctx context.Context) {
+		if err := cursor.Close(ctx); err != nil {
+			br.logger.Warnf("error closing cursor: %v", err)
+		}
+	}(cursor, ctx)
+
+	var coreBooks []*repomodels.BookModel
+	if err = cursor.All(ctx, &coreBooks); err != nil {
+		return nil, logRepoError(br.logger, "error decoding books", err)
+	}
+
 	if len(coreBooks) == 0 {
-		br.logger.Printf("books not found with these params")
+		br.logger.Warnf("books not found by query: %s", query)
 		return nil, errs.ErrBookDoesNotExists
 	}
 
-	br.logger.Printf("found %d books", len(coreBooks))
+	br.logger.Debugf("found %d books by query: %s", len(coreBooks), query)
 
 	books := make([]*models.BookModel, len(coreBooks))
 	for i, book := range coreBooks {
-		books[i] = br.convertToBookModel(book)
+		books[i] = convertToBookModel(book)
 	}
 
 	return books, nil
 }
 
-func (br *BookRepo) getFilterByParams(params *dto.BookParamsDTO) bson.M {
+func (br *BookRepo) getFilterByParams(params *repodto.BookParamsDTO) bson.M {
 	filter := bson.M{}
 
 	if params.Title != "" {
-		filter["title"] = bson.M{"$regex": params.Title, "$options": "i"}
+		filter["title"] = bson.M{"$regex": regexp.QuoteMeta(params.Title), "$options": "i"}
 	}
 	if params.Author != "" {
-		filter["author"] = bson.M{"$regex": params.Author, "$options": "i"}
+		filter["author"] = bson.M{"$regex": regexp.QuoteMeta(params.Author), "$options": "i"}
 	}
 	if params.Publisher != "" {
-		filter["publisher"] = bson.M{"$regex": params.Publisher, "$options": "i"}
+		filter["publisher"] = bson.M{"$regex": regexp.QuoteMeta(params.Publisher), "$options": "i"}
 	}
 	if params.CopiesNumber != 0 {
 		filter["copies_number"] = params.CopiesNumber
+	} else if params.AvailableOnly {
+		filter["copies_number"] = bson.M{"$gt": 0}
 	}
-	if params.Rarity != "" {
+	if len(params.Rarities) > 0 {
+		filter["rarity"] = bson.M{"$in": params.Rarities}
+	} else if params.Rarity != "" {
 		filter["rarity"] = params.Rarity
 	}
-	if params.Genre != "" {
-		filter["genre"] = bson.M{"$regex": params.Genre, "$options": "i"}
+	if len(params.Genres) > 0 {
+		filter["genre"] = bson.M{"$in": params.Genres}
+	} else if params.Genre != "" {
+		filter["genre"] = bson.M{"$regex": regexp.QuoteMeta(params.Genre), "$options": "i"}
 	}
 	if params.PublishingYear != 0 {
 		filter["publishing_year"] = params.PublishingYear
+	} else if yearRange := br.getRangeFilter(params.PublishingYearFrom, params.PublishingYearTo); yearRange != nil {
+		filter["publishing_year"] = yearRange
 	}
-	if params.Language != "" {
-		filter["language"] = bson.M{"$regex": params.Language, "$options": "i"}
+	if len(params.Languages) > 0 {
+		filter["language"] = bson.M{"$in": params.Languages}
+	} else if params.Language != "" {
+		filter["language"] = bson.M{"$regex": regexp.QuoteMeta(params.Language), "$options": "i"}
 	}
 	if params.AgeLimit != 0 {
 		filter["age_limit"] = params.AgeLimit
+	} else if params.AgeLimitMax != 0 {
+		filter["age_limit"] = bson.M{"$lte": params.AgeLimitMax}
+	}
+	if params.RatingAvgMin != 0 {
+		filter["rating_avg"] = bson.M{"$gte": params.RatingAvgMin}
 	}
 
 	return filter
 }
 
-func (br *BookRepo) convertToBookModel(book *repomodels.BookModel) *models.BookModel {
+func (br *BookRepo) getRangeFilter(from, to uint) bson.M {
+	if from == 0 && to == 0 {
+		return nil
+	}
+
+	bounds := bson.M{}
+	if from != 0 {
+		bounds["$gte"] = from
+	}
+	if to != 0 {
+		bounds["$lte"] = to
+	}
+
+	return bounds
+}
+
+// bookSortKeys -- поле документа и направление сортировки по умолчанию для каждого варианта сортировки
+var bookSortKeys = map[repodto.BookSortField]bson.E{
+	repodto.BookSortByTitle:          {Key: "title", Value: 1},
+	repodto.BookSortByAuthor:         {Key: "author", Value: 1},
+	repodto.BookSortByPublishingYear: {Key: "publishing_year", Value: 1},
+	repodto.BookSortByCopiesNumber:   {Key: "copies_number", Value: 1},
+	repodto.BookSortByRating:         {Key: "rating_avg", Value: -1},
+	repodto.BookSortByNewest:         {Key: "created_at", Value: -1},
+}
+
+var defaultBookSort = repodto.BookSortDTO{Field: repodto.BookSortByTitle}
+
+func (br *BookRepo) getSort(sort *repodto.BookSortDTO) (bson.D, error) {
+	key, ok := bookSortKeys[sort.Field]
+	if !ok {
+		return nil, repoerrs.ErrInvalidBookSort
+	}
+
+	direction := key.Value.(int)
+	if sort.Desc {
+		direction = -direction
+	}
+
+	return bson.D{{Key: key.Key, Value: direction}, {Key: "_id", Value: direction}}, nil
+}
+
+func (br *BookRepo) getSortName(sort *repodto.BookSortDTO) string {
+	if sort.Desc {
+		return string(sort.Field) + ":desc"
+	}
+
+	return string(sort.Field)
+}
+
+func (br *BookRepo) convertToFacetBuckets(buckets []facetBucket) []repodto.FacetBucketDTO {
+	converted := make([]repodto.FacetBucketDTO, len(buckets))
+	for i, bucket := range buckets {
+		converted[i] = repodto.FacetBucketDTO{Value: bucket.Value, Count: bucket.Count}
+	}
+
+	return converted
+}
+
+// convertToBookModel используется также ReaderRepo для избранных книг
+func convertToBookModel(book *repomodels.BookModel) *models.BookModel {
 	return &models.BookModel{
 		ID:             book.ID,
 		Title:          book.Title,
@@ -0,0 +1,142 @@
+//go:build integration
+
+package impl_test
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	repoMongo "github.com/nikitalystsev/BookSmart-repo-mongo"
+	repoerrs "github.com/nikitalystsev/BookSmart-repo-mongo/core/errs"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/impl"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/pkg/transact"
+	"github.com/nikitalystsev/BookSmart-services/core/models"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const concurrentWorkers = 20
+
+// newIntegrationBookRepo подключается к набору реплик из MONGO_URL и создает репозиторий во временной БД
+func newIntegrationBookRepo(t *testing.T) *impl.BookRepo {
+	t.Helper()
+
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		t.Skip("MONGO_URL is not set")
+	}
+
+	client, err := repoMongo.NewClient(url, "", "", "", repoMongo.WithConnectTimeout(3*time.Second))
+	if err != nil {
+		t.Skipf("MongoDB is unreachable: %v", err)
+	}
+
+	ctx := context.Background()
+	supported, err := transact.TransactionsSupported(ctx, client)
+	if err != nil || !supported {
+		_ = client.Disconnect(ctx)
+		t.Skipf("MongoDB at MONGO_URL is not a replica set: %v", err)
+	}
+
+	db := client.Database("booksmart_it_" + uuid.NewString()[:8])
+	t.Cleanup(func() {
+		if err := db.Drop(ctx); err != nil {
+			t.Errorf("error dropping database: %v", err)
+		}
+		if err := client.Disconnect(ctx); err != nil {
+			t.Errorf("error disconnecting MongoDB: %v", err)
+		}
+	})
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	return impl.NewBookRepo(db, logrus.NewEntry(logger))
+}
+
+func createBook(t *testing.T, repo *impl.BookRepo, copies uint) *models.BookModel {
+	t.Helper()
+
+	book := &models.BookModel{ID: uuid.New(), Title: "Integration", Author: "Test", CopiesNumber: copies}
+	if err := repo.Create(context.Background(), book); err != nil {
+		t.Fatalf("error creating book: %v", err)
+	}
+
+	return book
+}
+
+// runConcurrently запускает fn в concurrentWorkers горутинах одновременно и возвращает их ошибки
+func runConcurrently(fn func() error) []error {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	results := make([]error, concurrentWorkers)
+
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			results[i] = fn()
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	return results
+}
+
+func TestDecrementCopiesConcurrent(t *testing.T) {
+	repo := newIntegrationBookRepo(t)
+	book := createBook(t, repo, 1)
+
+	results := runConcurrently(func() error {
+		return repo.DecrementCopies(context.Background(), book.ID)
+	})
+
+	succeeded := 0
+	for _, err := range results {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, repoerrs.ErrBookNoCopiesLeft):
+			t.Errorf("expected ErrBookNoCopiesLeft, got %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected exactly 1 successful decrement, got %d", succeeded)
+	}
+
+	got, err := repo.GetByID(context.Background(), book.ID)
+	if err != nil {
+		t.Fatalf("error getting book: %v", err)
+	}
+	if got.CopiesNumber != 0 {
+		t.Errorf("expected 0 copies left, got %d", got.CopiesNumber)
+	}
+}
+
+func TestIncrementCopiesConcurrent(t *testing.T) {
+	repo := newIntegrationBookRepo(t)
+	book := createBook(t, repo, 0)
+
+	results := runConcurrently(func() error {
+		return repo.IncrementCopies(context.Background(), book.ID)
+	})
+
+	for _, err := range results {
+		if err != nil {
+			t.Errorf("error incrementing copies: %v", err)
+		}
+	}
+
+	got, err := repo.GetByID(context.Background(), book.ID)
+	if err != nil {
+		t.Fatalf("error getting book: %v", err)
+	}
+	if got.CopiesNumber != concurrentWorkers {
+		t.Errorf("expected %d copies, got %d", concurrentWorkers, got.CopiesNumber)
+	}
+}
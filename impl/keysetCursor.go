@@ -0,0 +1,82 @@
+package impl
+
+import (
+	"encoding/base64"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// keysetCursor -- содержимое токена продолжения: сортировка, для которой он выдан, и ключ последнего документа страницы
+type keysetCursor struct {
+	Sort  string        `bson:"s"`
+	Value bson.RawValue `bson:"v"`
+	ID    bson.RawValue `bson:"id"`
+}
+
+// encodeKeysetCursor кодирует в токен значения первого ключа sortData и _id документа last.
+// Отсутствующее поле кодируется как null: при сортировке MongoDB не различает их
+func encodeKeysetCursor(sort string, last bson.Raw, sortData bson.D) (string, error) {
+	value := last.Lookup(sortData[0].Key)
+	if value.Type == 0 {
+		value = bson.RawValue{Type: bsontype.Null}
+	}
+
+	data, err := bson.Marshal(keysetCursor{
+		Sort:  sort,
+		Value: value,
+		ID:    last.Lookup("_id"),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// getKeysetFilter возвращает фильтр документов, следующих за ключом из токена, при сортировке sortData вида
+// {поле: направление, _id: направление}. ok == false, если токен поврежден или выдан для другой сортировки
+func getKeysetFilter(token, sort string, sortData bson.D) (filter bson.M, ok bool) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, false
+	}
+
+	var c keysetCursor
+	if err = bson.Unmarshal(data, &c); err != nil {
+		return nil, false
+	}
+	if c.Sort != sort || c.ID.Type == 0 {
+		return nil, false
+	}
+
+	key := sortData[0].Key
+	op := "$gt"
+	if sortData[0].Value.(int) < 0 {
+		op = "$lt"
+	}
+
+	// null меньше любого значения, но операторы сравнения с null не находят документы других типов
+	if c.Value.Type == 0 || c.Value.Type == bsontype.Null {
+		if op == "$lt" {
+			return bson.M{key: nil, "_id": bson.M{op: c.ID}}, true
+		}
+
+		return bson.M{
+			"$or": bson.A{
+				bson.M{key: bson.M{"$ne": nil}},
+				bson.M{key: nil, "_id": bson.M{op: c.ID}},
+			},
+		}, true
+	}
+
+	or := bson.A{
+		bson.M{key: bson.M{op: c.Value}},
+		bson.M{key: c.Value, "_id": bson.M{op: c.ID}},
+	}
+	// при убывающей сортировке документы без поля идут после всех остальных
+	if op == "$lt" {
+		or = append(or, bson.M{key: nil})
+	}
+
+	return bson.M{"$or": or}, true
+}
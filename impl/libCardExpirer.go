@@ -0,0 +1,60 @@
+package impl
+
+import (
+	"context"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/pkg/sweeper"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+const msPerDay = int64(24 * time.Hour / time.Millisecond)
+
+// LibCardExpirer деактивирует читательские билеты, у которых истек срок действия issue_date + validity
+type LibCardExpirer struct {
+	db     *mongo.Collection
+	logger *logrus.Entry
+}
+
+func NewLibCardExpirer(db *mongo.Database, logger *logrus.Entry) *LibCardExpirer {
+	return &LibCardExpirer{db: db.Collection("lib_card"), logger: logger}
+}
+
+// ExpireOverdue деактивирует билеты, срок действия которых истек к моменту now, и возвращает их количество
+func (lce *LibCardExpirer) ExpireOverdue(ctx context.Context, now time.Time) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "lib_card", "ExpireOverdue")
+	defer func() { span.end(err) }()
+
+	lce.logger.Debugf("expiring libCards overdue at %s", now)
+
+	filter := bson.M{
+		"action_status": true,
+		"$expr":         bson.M{"$lt": bson.A{libCardExpiryDateExpr(), now}},
+	}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"action_status": false,
+			"version":       bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}},
+		}}},
+	}
+
+	result, err := lce.db.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, logRepoError(lce.logger, "error expiring libCards", err)
+	}
+
+	lce.logger.Infof("expired %d libCards", result.ModifiedCount)
+
+	return result.ModifiedCount, nil
+}
+
+// Sweeper возвращает фоновую задачу, вызывающую ExpireOverdue каждые interval
+func (lce *LibCardExpirer) Sweeper(interval time.Duration) *sweeper.Sweeper {
+	return sweeper.NewSweeper("libCard expiry", interval, lce.ExpireOverdue, lce.logger)
+}
+
+// libCardExpiryDateExpr -- выражение агрегации для даты окончания действия билета (validity задается в днях)
+func libCardExpiryDateExpr() bson.M {
+	return bson.M{"$add": bson.A{"$issue_date", bson.M{"$multiply": bson.A{"$validity", msPerDay}}}}
+}
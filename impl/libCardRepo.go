@@ -4,13 +4,16 @@ import (
 	"context"
 	"errors"
 	"github.com/google/uuid"
+	repoerrs "github.com/nikitalystsev/BookSmart-repo-mongo/core/errs"
 	repomodels "github.com/nikitalystsev/BookSmart-repo-mongo/core/models"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/pkg/transact"
 	"github.com/nikitalystsev/BookSmart-services/core/models"
 	"github.com/nikitalystsev/BookSmart-services/errs"
 	"github.com/nikitalystsev/BookSmart-services/intfRepo"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"time"
 )
 
@@ -19,37 +22,42 @@ type LibCardRepo struct {
 	logger *logrus.Entry
 }
 
-func NewLibCardRepo(db *mongo.Database, logger *logrus.Entry) intfRepo.ILibCardRepo {
+var _ intfRepo.ILibCardRepo = (*LibCardRepo)(nil)
+
+func NewLibCardRepo(db *mongo.Database, logger *logrus.Entry) *LibCardRepo {
 	return &LibCardRepo{db: db.Collection("lib_card"), logger: logger}
 }
 
-func (lcr *LibCardRepo) Create(ctx context.Context, libCard *models.LibCardModel) error {
-	lcr.logger.Infof("inserting libCard with ID: %s", libCard.ID)
+func (lcr *LibCardRepo) Create(ctx context.Context, libCard *models.LibCardModel) (err error) {
+	ctx, span := startSpan(ctx, "lib_card", "Create")
+	defer func() { span.end(err) }()
+
+	lcr.logger.Debugf("inserting libCard with ID: %s", libCard.ID)
+
+	ctx = transact.SessionContext(ctx)
 
-	_, err := lcr.db.InsertOne(ctx, lcr.convertToRepoLibCardModel(libCard))
+	_, err = lcr.db.InsertOne(ctx, lcr.convertToRepoLibCardModel(libCard))
 	if err != nil {
-		lcr.logger.Errorf("error inserting libCard: %v", err)
-		return err
+		return logRepoError(lcr.logger, "error inserting libCard", err)
 	}
 
-	lcr.logger.Infof("inserted libCard with ID: %s", libCard.ID)
+	lcr.logger.Debugf("inserted libCard with ID: %s", libCard.ID)
 
 	return nil
 }
 
-func (lcr *LibCardRepo) GetByReaderID(ctx context.Context, readerID uuid.UUID) (*models.LibCardModel, error) {
-	lcr.logger.Infof("find libCard with readerID: %s", readerID)
+func (lcr *LibCardRepo) GetByReaderID(ctx context.Context, readerID uuid.UUID) (_ *models.LibCardModel, err error) {
+	ctx, span := startSpan(ctx, "lib_card", "GetByReaderID")
+	defer func() { span.end(err) }()
 
-	if err := lcr.updateActionStatus(ctx); err != nil {
-		lcr.logger.Errorf("error updating libCard status: %v", err)
-		return nil, err
-	}
+	lcr.logger.Debugf("find libCard with readerID: %s", readerID)
+
+	ctx = transact.SessionContext(ctx)
 
 	one := lcr.db.FindOne(ctx, bson.M{"reader_id": readerID})
 
 	if one.Err() != nil && !errors.Is(one.Err(), mongo.ErrNoDocuments) {
-		lcr.logger.Errorf("error find libCard: %v", one.Err())
-		return nil, one.Err()
+		return nil, logRepoError(lcr.logger, "error find libCard", one.Err())
 	}
 	if one.Err() != nil && errors.Is(one.Err(), mongo.ErrNoDocuments) {
 		lcr.logger.Warnf("libCard with this readerID not found: %v", readerID)
@@ -58,28 +66,26 @@ func (lcr *LibCardRepo) GetByReaderID(ctx context.Context, readerID uuid.UUID) (
 
 	var libCard repomodels.LibCardModel
 	if err := one.Decode(&libCard); err != nil {
-		lcr.logger.Errorf("error decoding libCard: %v", err)
-		return nil, err
+		return nil, logRepoError(lcr.logger, "error decoding libCard", err)
 	}
 
-	lcr.logger.Infof("found libCard with readerID: %s", readerID)
+	lcr.logger.Debugf("found libCard with readerID: %s", readerID)
 
 	return lcr.convertToLibCardModel(&libCard), nil
 }
 
-func (lcr *LibCardRepo) GetByNum(ctx context.Context, libCardNum string) (*models.LibCardModel, error) {
-	lcr.logger.Infof("find libCard with num: %s", libCardNum)
+func (lcr *LibCardRepo) GetByNum(ctx context.Context, libCardNum string) (_ *models.LibCardModel, err error) {
+	ctx, span := startSpan(ctx, "lib_card", "GetByNum")
+	defer func() { span.end(err) }()
 
-	if err := lcr.updateActionStatus(ctx); err != nil {
-		lcr.logger.Errorf("error updating libCard status: %v", err)
-		return nil, err
-	}
+	lcr.logger.Debugf("find libCard with num: %s", libCardNum)
+
+	ctx = transact.SessionContext(ctx)
 
 	one := lcr.db.FindOne(ctx, bson.M{"lib_card_num": libCardNum})
 
 	if one.Err() != nil && !errors.Is(one.Err(), mongo.ErrNoDocuments) {
-		lcr.logger.Errorf("error find libCard: %v", one.Err())
-		return nil, one.Err()
+		return nil, logRepoError(lcr.logger, "error find libCard", one.Err())
 	}
 	if one.Err() != nil && errors.Is(one.Err(), mongo.ErrNoDocuments) {
 		lcr.logger.Warnf("libCard with this num not found: %v", libCardNum)
@@ -88,32 +94,26 @@ func (lcr *LibCardRepo) GetByNum(ctx context.Context, libCardNum string) (*model
 
 	var libCard repomodels.LibCardModel
 	if err := one.Decode(&libCard); err != nil {
-		lcr.logger.Errorf("error decoding libCard: %v", err)
-		return nil, err
+		return nil, logRepoError(lcr.logger, "error decoding libCard", err)
 	}
 
-	lcr.logger.Infof("found libCard with num: %s", libCardNum)
+	lcr.logger.Debugf("found libCard with num: %s", libCardNum)
 
 	return lcr.convertToLibCardModel(&libCard), nil
 }
 
-func (lcr *LibCardRepo) Update(ctx context.Context, libCard *models.LibCardModel) error {
-	lcr.logger.Infof("updating libCard with ID: %s", libCard.ID)
+// Update обновляет билет без проверки версии. Для оптимистичной блокировки -- GetByReaderIDWithVersion и UpdateWithVersion
+func (lcr *LibCardRepo) Update(ctx context.Context, libCard *models.LibCardModel) (err error) {
+	ctx, span := startSpan(ctx, "lib_card", "Update")
+	defer func() { span.end(err) }()
 
-	updateData := bson.M{
-		"$set": bson.M{
-			"reader_id":     libCard.ReaderID,
-			"lib_card_num":  libCard.LibCardNum,
-			"validity":      libCard.Validity,
-			"issue_date":    libCard.IssueDate,
-			"action_status": libCard.ActionStatus,
-		},
-	}
+	lcr.logger.Debugf("updating libCard with ID: %s", libCard.ID)
 
-	one, err := lcr.db.UpdateOne(ctx, bson.M{"_id": libCard.ID}, updateData)
+	ctx = transact.SessionContext(ctx)
+
+	one, err := lcr.db.UpdateOne(ctx, bson.M{"_id": libCard.ID}, lcr.getUpdateData(libCard))
 	if err != nil {
-		lcr.logger.Errorf("error updating libCard: %v", err)
-		return err
+		return logRepoError(lcr.logger, "error updating libCard", err)
 	}
 
 	if one.MatchedCount == 0 {
@@ -121,26 +121,143 @@ func (lcr *LibCardRepo) Update(ctx context.Context, libCard *models.LibCardModel
 		return errs.ErrLibCardDoesNotExists
 	}
 
-	lcr.logger.Infof("updated libCard with ID: %s", libCard.ID)
+	lcr.logger.Debugf("updated libCard with ID: %s", libCard.ID)
+
+	return nil
+}
+
+// GetByReaderIDWithVersion возвращает билет читателя вместе с его текущей версией для последующего UpdateWithVersion
+func (lcr *LibCardRepo) GetByReaderIDWithVersion(ctx context.Context, readerID uuid.UUID) (_ *models.LibCardModel, _ int64, err error) {
+	ctx, span := startSpan(ctx, "lib_card", "GetByReaderIDWithVersion")
+	defer func() { span.end(err) }()
+
+	lcr.logger.Debugf("find libCard with version by readerID: %s", readerID)
+
+	ctx = transact.SessionContext(ctx)
+
+	one := lcr.db.FindOne(ctx, bson.M{"reader_id": readerID})
+
+	if one.Err() != nil && !errors.Is(one.Err(), mongo.ErrNoDocuments) {
+		return nil, 0, logRepoError(lcr.logger, "error find libCard", one.Err())
+	}
+	if one.Err() != nil && errors.Is(one.Err(), mongo.ErrNoDocuments) {
+		lcr.logger.Warnf("libCard with this readerID not found: %v", readerID)
+		return nil, 0, errs.ErrLibCardDoesNotExists
+	}
+
+	var libCard repomodels.LibCardModel
+	if err := one.Decode(&libCard); err != nil {
+		return nil, 0, logRepoError(lcr.logger, "error decoding libCard", err)
+	}
+
+	lcr.logger.Debugf("found libCard with readerID: %s, version: %d", readerID, libCard.Version)
+
+	return lcr.convertToLibCardModel(&libCard), libCard.Version, nil
+}
+
+// UpdateWithVersion обновляет билет, только если его версия в БД равна version.
+// Если билет уже изменил кто-то другой, возвращается repoerrs.ErrLibCardVersionConflict
+func (lcr *LibCardRepo) UpdateWithVersion(ctx context.Context, libCard *models.LibCardModel, version int64) (err error) {
+	ctx, span := startSpan(ctx, "lib_card", "UpdateWithVersion")
+	defer func() { span.end(err) }()
+
+	lcr.logger.Debugf("updating libCard with ID: %s, expected version: %d", libCard.ID, version)
+
+	ctx = transact.SessionContext(ctx)
+
+	filter := getVersionFilter(libCard.ID, version)
+
+	one, err := lcr.db.UpdateOne(ctx, filter, lcr.getUpdateData(libCard))
+	if err != nil {
+		return logRepoError(lcr.logger, "error updating libCard", err)
+	}
+
+	if one.MatchedCount == 0 {
+		return lcr.checkVersionConflictReason(ctx, libCard.ID)
+	}
+
+	lcr.logger.Debugf("updated libCard with ID: %s", libCard.ID)
 
 	return nil
 }
 
-func (lcr *LibCardRepo) updateActionStatus(ctx context.Context) error {
+// GetExpiringWithin возвращает действующие билеты, срок действия которых истекает в ближайшие days дней
+func (lcr *LibCardRepo) GetExpiringWithin(ctx context.Context, days int) (_ []*models.LibCardModel, err error) {
+	ctx, span := startSpan(ctx, "lib_card", "GetExpiringWithin")
+	defer func() { span.end(err) }()
+
+	lcr.logger.Debugf("find libCards expiring within %d days", days)
+
+	ctx = transact.SessionContext(ctx)
+
+	now := time.Now()
 	filter := bson.M{
 		"action_status": true,
-		"issue_date":    bson.M{"$lt": time.Now().AddDate(0, 0, -365)},
+		"$expr": bson.M{
+			"$and": bson.A{
+				bson.M{"$gte": bson.A{libCardExpiryDateExpr(), now}},
+				bson.M{"$lt": bson.A{libCardExpiryDateExpr(), now.AddDate(0, 0, days)}},
+			},
+		},
+	}
+
+	cursor, err := lcr.db.Find(ctx, filter, options.Find().SetSort(bson.M{"issue_date": 1}))
+	if err != nil {
+		return nil, logRepoError(lcr.logger, "error find expiring libCards", err)
 	}
-	update := bson.M{
-		"$set": bson.M{"action_status": false},
+	defer func(cursor *mongo.Cursor, ctx context.Context) {
+		if err := cursor.Close(ctx); err != nil {
+			lcr.logger.Warnf("error closing cursor: %v", err)
+		}
+	}(cursor, ctx)
+
+	var coreLibCards []*repomodels.LibCardModel
+	if err = cursor.All(ctx, &coreLibCards); err != nil {
+		return nil, logRepoError(lcr.logger, "error decoding libCards", err)
 	}
 
-	_, err := lcr.db.UpdateMany(ctx, filter, update)
+	if len(coreLibCards) == 0 {
+		lcr.logger.Warnf("libCards expiring within %d days not found", days)
+		return nil, errs.ErrLibCardDoesNotExists
+	}
+
+	lcr.logger.Debugf("found %d libCards expiring within %d days", len(coreLibCards), days)
+
+	libCards := make([]*models.LibCardModel, len(coreLibCards))
+	for i, coreLibCard := range coreLibCards {
+		libCards[i] = lcr.convertToLibCardModel(coreLibCard)
+	}
+
+	return libCards, nil
+}
+
+func (lcr *LibCardRepo) checkVersionConflictReason(ctx context.Context, ID uuid.UUID) error {
+	count, err := lcr.db.CountDocuments(ctx, bson.M{"_id": ID})
 	if err != nil {
-		return err
+		return logRepoError(lcr.logger, "error find libCard", err)
 	}
 
-	return nil
+	if count == 0 {
+		lcr.logger.Warnf("libCard with this ID not found: %v", ID)
+		return errs.ErrLibCardDoesNotExists
+	}
+
+	lcr.logger.Warnf("libCard with ID %s was modified by another writer", ID)
+
+	return repoerrs.ErrLibCardVersionConflict
+}
+
+func (lcr *LibCardRepo) getUpdateData(libCard *models.LibCardModel) bson.M {
+	return bson.M{
+		"$set": bson.M{
+			"reader_id":     libCard.ReaderID,
+			"lib_card_num":  libCard.LibCardNum,
+			"validity":      libCard.Validity,
+			"issue_date":    libCard.IssueDate,
+			"action_status": libCard.ActionStatus,
+		},
+		"$inc": bson.M{"version": 1},
+	}
 }
 
 func (lcr *LibCardRepo) convertToLibCardModel(libCard *repomodels.LibCardModel) *models.LibCardModel {
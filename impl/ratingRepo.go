@@ -5,46 +5,191 @@ import (
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	repodto "github.com/nikitalystsev/BookSmart-repo-mongo/core/dto"
+	repoerrs "github.com/nikitalystsev/BookSmart-repo-mongo/core/errs"
 	repomodels "github.com/nikitalystsev/BookSmart-repo-mongo/core/models"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/pkg/transact"
 	"github.com/nikitalystsev/BookSmart-services/core/models"
 	"github.com/nikitalystsev/BookSmart-services/errs"
 	"github.com/nikitalystsev/BookSmart-services/intfRepo"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
 )
 
 type RatingRepo struct {
 	db     *mongo.Collection
+	dbBook *mongo.Collection
 	logger *logrus.Entry
 }
 
-func NewRatingRepo(db *mongo.Database, logger *logrus.Entry) intfRepo.IRatingRepo {
-	return &RatingRepo{db: db.Collection("rating"), logger: logger}
+var _ intfRepo.IRatingRepo = (*RatingRepo)(nil)
+
+func NewRatingRepo(db *mongo.Database, logger *logrus.Entry) *RatingRepo {
+	return &RatingRepo{db: db.Collection("rating"), dbBook: db.Collection("book"), logger: logger}
 }
 
-func (rr *RatingRepo) Create(ctx context.Context, rating *models.RatingModel) error {
-	rr.logger.Infof("inserting rating with ID: %s", rating.ID)
+func (rr *RatingRepo) Create(ctx context.Context, rating *models.RatingModel) (err error) {
+	ctx, span := startSpan(ctx, "rating", "Create")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("inserting rating with ID: %s", rating.ID)
 
-	_, err := rr.db.InsertOne(ctx, rr.convertToRepoRatingModel(rating))
+	err = transact.WithTransaction(ctx, rr.db.Database().Client(), func(ctx context.Context) error {
+		repoRating := rr.convertToRepoRatingModel(rating)
+		repoRating.CreatedAt = time.Now()
+		repoRating.Status = rr.getInitialStatus(rating.Review)
+
+		if _, err := rr.db.InsertOne(ctx, repoRating); err != nil {
+			return err
+		}
+
+		sum, count := rr.getSummaryContribution(repoRating)
+
+		return rr.updateBookRatingSummary(ctx, rating.BookID, sum, count)
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		rr.logger.Warnf("reader %s already rated book %s", rating.ReaderID, rating.BookID)
+		return repoerrs.ErrRatingDuplicate
+	}
 	if err != nil {
-		rr.logger.Errorf("error inserting rating: %v", err)
-		return err
+		return logRepoError(rr.logger, "error inserting rating", err)
+	}
+
+	rr.logger.Debugf("inserted rating with ID: %s", rating.ID)
+
+	return nil
+}
+
+// Update изменяет отзыв и оценку и обновляет сводку рейтинга книги в той же транзакции.
+// Измененный отзыв заново отправляется на модерацию
+func (rr *RatingRepo) Update(ctx context.Context, rating *models.RatingModel) (err error) {
+	ctx, span := startSpan(ctx, "rating", "Update")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("updating rating with ID: %s", rating.ID)
+
+	err = transact.WithTransaction(ctx, rr.db.Database().Client(), func(ctx context.Context) error {
+		repoRating := rr.convertToRepoRatingModel(rating)
+		repoRating.Status = rr.getInitialStatus(rating.Review)
+
+		var old repomodels.RatingModel
+		err := rr.db.FindOneAndUpdate(ctx, bson.M{"_id": rating.ID}, rr.getUpdatePipeline(repoRating)).Decode(&old)
+		if err != nil {
+			return err
+		}
+		if old.Review == repoRating.Review {
+			repoRating.Status = old.Status
+		}
+
+		return rr.updateBookRatingSummaryDiff(ctx, old.BookID, &old, repoRating)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		rr.logger.Warnf("rating with this ID not found: %s", rating.ID)
+		return errs.ErrRatingDoesNotExists
+	}
+	if err != nil {
+		return logRepoError(rr.logger, "error updating rating", err)
+	}
+
+	rr.logger.Debugf("updated rating with ID: %s", rating.ID)
+
+	return nil
+}
+
+// Delete удаляет оценку и обновляет сводку рейтинга книги в той же транзакции
+func (rr *RatingRepo) Delete(ctx context.Context, ID uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "rating", "Delete")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("deleting rating with ID: %s", ID)
+
+	err = transact.WithTransaction(ctx, rr.db.Database().Client(), func(ctx context.Context) error {
+		var old repomodels.RatingModel
+		if err := rr.db.FindOneAndDelete(ctx, bson.M{"_id": ID}).Decode(&old); err != nil {
+			return err
+		}
+
+		sum, count := rr.getSummaryContribution(&old)
+
+		return rr.updateBookRatingSummary(ctx, old.BookID, -sum, -count)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		rr.logger.Warnf("rating with this ID not found: %s", ID)
+		return errs.ErrRatingDoesNotExists
+	}
+	if err != nil {
+		return logRepoError(rr.logger, "error deleting rating", err)
+	}
+
+	rr.logger.Debugf("deleted rating with ID: %s", ID)
+
+	return nil
+}
+
+// Rate создает оценку читателя для книги или заменяет существующую одной операцией.
+// Результат модерации сохраняется, если текст отзыва не изменился
+func (rr *RatingRepo) Rate(ctx context.Context, rating *models.RatingModel) (err error) {
+	ctx, span := startSpan(ctx, "rating", "Rate")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("reader %s rating book %s", rating.ReaderID, rating.BookID)
+
+	err = transact.WithTransaction(ctx, rr.db.Database().Client(), func(ctx context.Context) error {
+		repoRating := rr.convertToRepoRatingModel(rating)
+		repoRating.Status = rr.getInitialStatus(rating.Review)
+
+		filter := bson.M{"reader_id": rating.ReaderID, "book_id": rating.BookID}
+		// в конвейере нет $setOnInsert: при вставке _id и created_at отсутствуют и берутся из $ifNull
+		update := append(rr.getUpdatePipeline(repoRating), bson.D{{Key: "$set", Value: bson.M{
+			"_id":        bson.M{"$ifNull": bson.A{"$_id", rating.ID}},
+			"created_at": bson.M{"$ifNull": bson.A{"$created_at", time.Now()}},
+		}}})
+		opts := options.FindOneAndUpdate().SetUpsert(true)
+
+		var old repomodels.RatingModel
+		err := rr.db.FindOneAndUpdate(ctx, filter, update, opts).Decode(&old)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			sum, count := rr.getSummaryContribution(repoRating)
+
+			return rr.updateBookRatingSummary(ctx, rating.BookID, sum, count)
+		}
+		if err != nil {
+			return err
+		}
+		if old.Review == repoRating.Review {
+			repoRating.Status = old.Status
+		}
+
+		return rr.updateBookRatingSummaryDiff(ctx, rating.BookID, &old, repoRating)
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		rr.logger.Warnf("reader %s already rated book %s", rating.ReaderID, rating.BookID)
+		return repoerrs.ErrRatingDuplicate
+	}
+	if err != nil {
+		return logRepoError(rr.logger, "error rating book", err)
 	}
 
-	rr.logger.Infof("inserted book with ID: %s", rating.ID)
+	rr.logger.Debugf("reader %s rated book %s", rating.ReaderID, rating.BookID)
 
 	return nil
 }
 
-func (rr *RatingRepo) GetByReaderAndBook(ctx context.Context, readerID, bookID uuid.UUID) (*models.RatingModel, error) {
-	rr.logger.Infof("find rating with readerID и bookID: %s и %s", readerID, bookID)
+func (rr *RatingRepo) GetByReaderAndBook(ctx context.Context, readerID, bookID uuid.UUID) (_ *models.RatingModel, err error) {
+	ctx, span := startSpan(ctx, "rating", "GetByReaderAndBook")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("find rating with readerID и bookID: %s и %s", readerID, bookID)
+
+	ctx = transact.SessionContext(ctx)
 
 	one := rr.db.FindOne(ctx, bson.M{"reader_id": readerID, "book_id": bookID})
 
 	if one.Err() != nil && !errors.Is(one.Err(), mongo.ErrNoDocuments) {
-		rr.logger.Errorf("error selecting rating: %v", one.Err())
-		return nil, one.Err()
+		return nil, logRepoError(rr.logger, "error selecting rating", one.Err())
 	}
 	if one.Err() != nil && errors.Is(one.Err(), mongo.ErrNoDocuments) {
 		rr.logger.Warnf("rating with this readerID и bookID not found: %s и %s", readerID, bookID)
@@ -53,38 +198,40 @@ func (rr *RatingRepo) GetByReaderAndBook(ctx context.Context, readerID, bookID u
 
 	var rating repomodels.RatingModel
 	if err := one.Decode(&rating); err != nil {
-		rr.logger.Errorf("error decoding rating: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error decoding rating", err)
 	}
 
-	rr.logger.Infof("found rating with readerID и bookID: %s и %s", readerID, bookID)
+	rr.logger.Debugf("found rating with readerID и bookID: %s и %s", readerID, bookID)
 
 	return rr.convertToRatingModel(&rating), nil
 }
 
-func (rr *RatingRepo) GetByBookID(ctx context.Context, bookID uuid.UUID) ([]*models.RatingModel, error) {
-	rr.logger.Infof("find ratings with bookID: %s", bookID)
+func (rr *RatingRepo) GetByBookID(ctx context.Context, bookID uuid.UUID) (_ []*models.RatingModel, err error) {
+	ctx, span := startSpan(ctx, "rating", "GetByBookID")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("find ratings with bookID: %s", bookID)
+
+	ctx = transact.SessionContext(ctx)
 
 	filter := bson.M{
 		"book_id": bookID,
+		"status":  repomodels.ReviewApproved,
 	}
 
 	cursor, err := rr.db.Find(ctx, filter)
 	if err != nil {
-		rr.logger.Errorf("error find ratings: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error find ratings", err)
 	}
 	defer func(cursor *mongo.Cursor, ctx context.Context) {
-		err = cursor.Close(ctx)
-		if err != nil {
-			fmt.Println("error close cursor")
+		if err := cursor.Close(ctx); err != nil {
+			rr.logger.Warnf("error closing cursor: %v", err)
 		}
 	}(cursor, ctx)
 
 	var coreRatings []*repomodels.RatingModel
 	if err = cursor.All(ctx, &coreRatings); err != nil {
-		rr.logger.Printf("error decoding ratings: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error decoding ratings", err)
 	}
 
 	if len(coreRatings) == 0 {
@@ -92,7 +239,7 @@ func (rr *RatingRepo) GetByBookID(ctx context.Context, bookID uuid.UUID) ([]*mod
 		return nil, errs.ErrRatingDoesNotExists
 	}
 
-	rr.logger.Infof("found ratings with bookID: %s", bookID)
+	rr.logger.Debugf("found ratings with bookID: %s", bookID)
 
 	ratings := make([]*models.RatingModel, len(coreRatings))
 	for i, coreReservation := range coreRatings {
@@ -102,6 +249,425 @@ func (rr *RatingRepo) GetByBookID(ctx context.Context, bookID uuid.UUID) ([]*mod
 	return ratings, nil
 }
 
+const defaultReviewsLimit = 20
+
+// reviewSortKeys -- поле документа и направление сортировки для каждого варианта сортировки ленты отзывов
+var reviewSortKeys = map[repodto.ReviewSort]bson.E{
+	repodto.ReviewSortNewest:  {Key: "created_at", Value: -1},
+	repodto.ReviewSortHighest: {Key: "rating", Value: -1},
+	repodto.ReviewSortLowest:  {Key: "rating", Value: 1},
+}
+
+// GetReviewsByBookID возвращает страницу ленты отзывов книги. Книга без отзывов дает пустую страницу, а не ошибку
+func (rr *RatingRepo) GetReviewsByBookID(ctx context.Context, bookID uuid.UUID, params *repodto.ReviewFeedParamsDTO) (_ *repodto.ReviewPageDTO, err error) {
+	ctx, span := startSpan(ctx, "rating", "GetReviewsByBookID")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("find reviews with bookID: %s", bookID)
+
+	ctx = transact.SessionContext(ctx)
+
+	sort := params.Sort
+	if sort == "" {
+		sort = repodto.ReviewSortNewest
+	}
+	key, ok := reviewSortKeys[sort]
+	if !ok {
+		rr.logger.Warnf("invalid review sort: %s", sort)
+		return nil, repoerrs.ErrInvalidReviewSort
+	}
+	sortData := bson.D{key, {Key: "_id", Value: key.Value}}
+
+	limit := params.Limit
+	if limit == 0 {
+		limit = defaultReviewsLimit
+	}
+
+	filter := bson.M{"book_id": bookID, "status": repomodels.ReviewApproved}
+	if params.WithReviewOnly {
+		filter["review"] = bson.M{"$exists": true, "$ne": ""}
+	}
+	if params.After != "" {
+		keyset, ok := getKeysetFilter(params.After, string(sort), sortData)
+		if !ok {
+			rr.logger.Warnf("invalid review cursor: %s", params.After)
+			return nil, repoerrs.ErrInvalidReviewCursor
+		}
+		filter = bson.M{"$and": bson.A{filter, keyset}}
+	}
+
+	// лишний документ показывает, есть ли следующая страница
+	findOptions := options.Find().SetSort(sortData).SetLimit(int64(limit) + 1)
+
+	cursor, err := rr.db.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, logRepoError(rr.logger, "error find reviews", err)
+	}
+	defer func(cursor *mongo.Cursor, ctx context.Context) {
+		if err := cursor.Close(ctx); err != nil {
+			rr.logger.Warnf("error closing cursor: %v", err)
+		}
+	}(cursor, ctx)
+
+	page := &repodto.ReviewPageDTO{Ratings: []*models.RatingModel{}}
+	var last bson.Raw
+	for cursor.Next(ctx) {
+		if uint(len(page.Ratings)) == limit {
+			if page.Next, err = encodeKeysetCursor(string(sort), last, sortData); err != nil {
+				return nil, logRepoError(rr.logger, "error encoding review cursor", err)
+			}
+			break
+		}
+
+		var rating repomodels.RatingModel
+		if err = cursor.Decode(&rating); err != nil {
+			return nil, logRepoError(rr.logger, "error decoding rating", err)
+		}
+		page.Ratings = append(page.Ratings, rr.convertToRatingModel(&rating))
+		last = append(last[:0], cursor.Current...)
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, logRepoError(rr.logger, "error find reviews", err)
+	}
+
+	rr.logger.Debugf("found %d reviews with bookID: %s", len(page.Ratings), bookID)
+
+	return page, nil
+}
+
+// Moderate выставляет отзыву статус модерации и обновляет сводку рейтинга книги в той же транзакции.
+// В сводке и публичных выборках учитываются только одобренные отзывы
+func (rr *RatingRepo) Moderate(ctx context.Context, ID, moderatorID uuid.UUID, status, reason string) (err error) {
+	ctx, span := startSpan(ctx, "rating", "Moderate")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("moderating rating with ID: %s", ID)
+
+	if status != repomodels.ReviewApproved && status != repomodels.ReviewRejected && status != repomodels.ReviewPending {
+		rr.logger.Warnf("invalid review status: %s", status)
+		return repoerrs.ErrInvalidReviewStatus
+	}
+
+	err = transact.WithTransaction(ctx, rr.db.Database().Client(), func(ctx context.Context) error {
+		update := bson.M{"$set": bson.M{
+			"status":            status,
+			"moderator_id":      moderatorID,
+			"moderated_at":      time.Now(),
+			"moderation_reason": reason,
+		}}
+
+		var old repomodels.RatingModel
+		if err := rr.db.FindOneAndUpdate(ctx, bson.M{"_id": ID}, update).Decode(&old); err != nil {
+			return err
+		}
+
+		moderated := old
+		moderated.Status = status
+
+		return rr.updateBookRatingSummaryDiff(ctx, old.BookID, &old, &moderated)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		rr.logger.Warnf("rating with this ID not found: %s", ID)
+		return errs.ErrRatingDoesNotExists
+	}
+	if err != nil {
+		return logRepoError(rr.logger, "error moderating rating", err)
+	}
+
+	rr.logger.Debugf("moderated rating with ID: %s, status: %s", ID, status)
+
+	return nil
+}
+
+const moderationQueueCursorSort = "moderation"
+
+// GetModerationQueue возвращает страницу отзывов, ожидающих модерации, начиная с самых старых
+func (rr *RatingRepo) GetModerationQueue(ctx context.Context, limit uint, after string) (_ *repodto.ReviewPageDTO, err error) {
+	ctx, span := startSpan(ctx, "rating", "GetModerationQueue")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("find reviews pending moderation")
+
+	ctx = transact.SessionContext(ctx)
+
+	if limit == 0 {
+		limit = defaultReviewsLimit
+	}
+	sortData := bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}
+
+	filter := bson.M{"status": repomodels.ReviewPending}
+	if after != "" {
+		keyset, ok := getKeysetFilter(after, moderationQueueCursorSort, sortData)
+		if !ok {
+			rr.logger.Warnf("invalid review cursor: %s", after)
+			return nil, repoerrs.ErrInvalidReviewCursor
+		}
+		filter = bson.M{"$and": bson.A{filter, keyset}}
+	}
+
+	// лишний документ показывает, есть ли следующая страница
+	findOptions := options.Find().SetSort(sortData).SetLimit(int64(limit) + 1)
+
+	cursor, err := rr.db.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, logRepoError(rr.logger, "error find reviews pending moderation", err)
+	}
+	defer func(cursor *mongo.Cursor, ctx context.Context) {
+		if err := cursor.Close(ctx); err != nil {
+			rr.logger.Warnf("error closing cursor: %v", err)
+		}
+	}(cursor, ctx)
+
+	page := &repodto.ReviewPageDTO{Ratings: []*models.RatingModel{}}
+	var last bson.Raw
+	for cursor.Next(ctx) {
+		if uint(len(page.Ratings)) == limit {
+			if page.Next, err = encodeKeysetCursor(moderationQueueCursorSort, last, sortData); err != nil {
+				return nil, logRepoError(rr.logger, "error encoding review cursor", err)
+			}
+			break
+		}
+
+		var rating repomodels.RatingModel
+		if err = cursor.Decode(&rating); err != nil {
+			return nil, logRepoError(rr.logger, "error decoding rating", err)
+		}
+		page.Ratings = append(page.Ratings, rr.convertToRatingModel(&rating))
+		last = append(last[:0], cursor.Current...)
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, logRepoError(rr.logger, "error find reviews pending moderation", err)
+	}
+
+	rr.logger.Debugf("found %d reviews pending moderation", len(page.Ratings))
+
+	return page, nil
+}
+
+type ratingStatsResult struct {
+	BookID uuid.UUID `bson:"_id"`
+	Avg    float64   `bson:"avg"`
+	Count  int64     `bson:"count"`
+	Score1 int64     `bson:"score_1"`
+	Score2 int64     `bson:"score_2"`
+	Score3 int64     `bson:"score_3"`
+	Score4 int64     `bson:"score_4"`
+	Score5 int64     `bson:"score_5"`
+}
+
+// GetStatsByBookID возвращает средний рейтинг, количество оценок и гистограмму оценок книги.
+// Для книги без оценок возвращается нулевая сводка
+func (rr *RatingRepo) GetStatsByBookID(ctx context.Context, bookID uuid.UUID) (_ *repodto.RatingStatsDTO, err error) {
+	ctx, span := startSpan(ctx, "rating", "GetStatsByBookID")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("calculating rating stats with bookID: %s", bookID)
+
+	stats, err := rr.getStatsByBookIDs(ctx, []uuid.UUID{bookID})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats[bookID], nil
+}
+
+// GetStatsByBookIDs возвращает сводки оценок для нескольких книг одним запросом.
+// В результате есть запись для каждого bookID, в том числе для книг без оценок
+func (rr *RatingRepo) GetStatsByBookIDs(ctx context.Context, bookIDs []uuid.UUID) (_ map[uuid.UUID]*repodto.RatingStatsDTO, err error) {
+	ctx, span := startSpan(ctx, "rating", "GetStatsByBookIDs")
+	defer func() { span.end(err) }()
+
+	return rr.getStatsByBookIDs(ctx, bookIDs)
+}
+
+// getStatsByBookIDs -- общая часть GetStatsByBookID и GetStatsByBookIDs без собственного span
+func (rr *RatingRepo) getStatsByBookIDs(ctx context.Context, bookIDs []uuid.UUID) (map[uuid.UUID]*repodto.RatingStatsDTO, error) {
+	if len(bookIDs) == 0 {
+		return map[uuid.UUID]*repodto.RatingStatsDTO{}, nil
+	}
+
+	rr.logger.Debugf("calculating rating stats for %d books", len(bookIDs))
+
+	ctx = transact.SessionContext(ctx)
+
+	group := bson.M{
+		"_id":   "$book_id",
+		"avg":   bson.M{"$avg": "$rating"},
+		"count": bson.M{"$sum": 1},
+	}
+	for score := 1; score <= 5; score++ {
+		group[fmt.Sprintf("score_%d", score)] = bson.M{
+			"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$rating", score}}, 1, 0}},
+		}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"book_id": bson.M{"$in": bookIDs}, "status": repomodels.ReviewApproved}}},
+		{{Key: "$group", Value: group}},
+	}
+
+	cursor, err := rr.db.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, logRepoError(rr.logger, "error calculating rating stats", err)
+	}
+	defer func(cursor *mongo.Cursor, ctx context.Context) {
+		if err := cursor.Close(ctx); err != nil {
+			rr.logger.Warnf("error closing cursor: %v", err)
+		}
+	}(cursor, ctx)
+
+	var results []*ratingStatsResult
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, logRepoError(rr.logger, "error decoding rating stats", err)
+	}
+
+	stats := make(map[uuid.UUID]*repodto.RatingStatsDTO, len(bookIDs))
+	for _, bookID := range bookIDs {
+		stats[bookID] = &repodto.RatingStatsDTO{BookID: bookID}
+	}
+	for _, result := range results {
+		stats[result.BookID] = &repodto.RatingStatsDTO{
+			BookID:    result.BookID,
+			Avg:       result.Avg,
+			Count:     result.Count,
+			Histogram: [5]int64{result.Score1, result.Score2, result.Score3, result.Score4, result.Score5},
+		}
+	}
+
+	rr.logger.Debugf("calculated rating stats for %d books", len(results))
+
+	return stats, nil
+}
+
+// RecomputeBookSummaries пересчитывает rating_sum, rating_count и rating_avg всех книг по коллекции rating
+func (rr *RatingRepo) RecomputeBookSummaries(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "rating", "RecomputeBookSummaries")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("recomputing book rating summaries")
+
+	pipeline := BookRatingSummaryPipeline(rr.db.Name(), rr.dbBook.Name(), bson.M{"status": repomodels.ReviewApproved})
+
+	cursor, err := rr.dbBook.Aggregate(ctx, pipeline)
+	if err != nil {
+		return logRepoError(rr.logger, "error recomputing book rating summaries", err)
+	}
+	if err = cursor.Close(ctx); err != nil {
+		return logRepoError(rr.logger, "error recomputing book rating summaries", err)
+	}
+
+	rr.logger.Debugf("recomputed book rating summaries")
+
+	return nil
+}
+
+// BookRatingSummaryPipeline возвращает конвейер по коллекции книг, который пересчитывает rating_sum, rating_count
+// и rating_avg по оценкам из ratingCollection, подходящим под ratingFilter, и записывает их в bookCollection.
+// Нулевой ratingFilter учитывает все оценки
+func BookRatingSummaryPipeline(ratingCollection, bookCollection string, ratingFilter bson.M) mongo.Pipeline {
+	// форма let/$expr вместо localField с pipeline, которую сервер понимает только с MongoDB 5.0
+	match := bson.M{"$expr": bson.M{"$eq": bson.A{"$book_id", "$$book_id"}}}
+	for key, value := range ratingFilter {
+		match[key] = value
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$lookup", Value: bson.M{
+			"from":     ratingCollection,
+			"let":      bson.M{"book_id": "$_id"},
+			"pipeline": mongo.Pipeline{{{Key: "$match", Value: match}}},
+			"as":       "ratings",
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"rating_sum":   bson.M{"$sum": "$ratings.rating"},
+			"rating_count": bson.M{"$size": "$ratings"},
+			"rating_avg":   bson.M{"$ifNull": bson.A{bson.M{"$avg": "$ratings.rating"}, 0}},
+		}}},
+		{{Key: "$merge", Value: bson.M{
+			"into":           bookCollection,
+			"on":             "_id",
+			"whenMatched":    "merge",
+			"whenNotMatched": "discard",
+		}}},
+	}
+}
+
+// updateBookRatingSummary изменяет сумму и количество оценок книги на sumDelta и countDelta и пересчитывает средний рейтинг
+func (rr *RatingRepo) updateBookRatingSummary(ctx context.Context, bookID uuid.UUID, sumDelta, countDelta int) error {
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"rating_sum":   bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$rating_sum", 0}}, sumDelta}},
+			"rating_count": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$rating_count", 0}}, countDelta}},
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"rating_avg": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$rating_count", 0}},
+				bson.M{"$divide": bson.A{"$rating_sum", "$rating_count"}},
+				0,
+			}},
+		}}},
+	}
+
+	one, err := rr.dbBook.UpdateOne(ctx, bson.M{"_id": bookID}, update)
+	if err != nil {
+		return err
+	}
+
+	if one.MatchedCount == 0 {
+		rr.logger.Warnf("book with this ID not found %s", bookID)
+		return errs.ErrBookDoesNotExists
+	}
+
+	return nil
+}
+
+// updateBookRatingSummaryDiff переносит в сводку рейтинга книги разницу между вкладами старой и новой версии оценки
+func (rr *RatingRepo) updateBookRatingSummaryDiff(ctx context.Context, bookID uuid.UUID, old, updated *repomodels.RatingModel) error {
+	oldSum, oldCount := rr.getSummaryContribution(old)
+	newSum, newCount := rr.getSummaryContribution(updated)
+
+	return rr.updateBookRatingSummary(ctx, bookID, newSum-oldSum, newCount-oldCount)
+}
+
+// getSummaryContribution возвращает вклад оценки в сумму и количество оценок книги. Учитываются только одобренные
+func (rr *RatingRepo) getSummaryContribution(rating *repomodels.RatingModel) (int, int) {
+	if rating.Status != repomodels.ReviewApproved {
+		return 0, 0
+	}
+
+	return rating.Rating, 1
+}
+
+// getInitialStatus -- оценка без текста отзыва не требует модерации
+func (rr *RatingRepo) getInitialStatus(review string) string {
+	if review == "" {
+		return repomodels.ReviewApproved
+	}
+
+	return repomodels.ReviewPending
+}
+
+// getUpdatePipeline возвращает обновление, которое отправляет оценку на повторную модерацию, только если изменился
+// текст отзыва. Иначе статус и результат модерации сохраняются
+func (rr *RatingRepo) getUpdatePipeline(rating *repomodels.RatingModel) mongo.Pipeline {
+	// выражения одной стадии $set вычисляются по документу до обновления, поэтому $review -- прежний текст
+	reviewChanged := bson.M{"$ne": bson.A{"$review", bson.M{"$literal": rating.Review}}}
+	keepUnlessChanged := func(field string) bson.M {
+		return bson.M{"$cond": bson.A{reviewChanged, "$$REMOVE", "$" + field}}
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"review":            bson.M{"$literal": rating.Review},
+			"rating":            rating.Rating,
+			"status":            bson.M{"$cond": bson.A{reviewChanged, rating.Status, "$status"}},
+			"moderator_id":      keepUnlessChanged("moderator_id"),
+			"moderated_at":      keepUnlessChanged("moderated_at"),
+			"moderation_reason": keepUnlessChanged("moderation_reason"),
+		}}},
+	}
+}
+
 func (rr *RatingRepo) convertToRatingModel(rating *repomodels.RatingModel) *models.RatingModel {
 	return &models.RatingModel{
 		ID:       rating.ID,
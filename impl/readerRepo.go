@@ -2,57 +2,78 @@ package impl
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
+	repodto "github.com/nikitalystsev/BookSmart-repo-mongo/core/dto"
+	repoerrs "github.com/nikitalystsev/BookSmart-repo-mongo/core/errs"
 	repomodels "github.com/nikitalystsev/BookSmart-repo-mongo/core/models"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/pkg/transact"
 	"github.com/nikitalystsev/BookSmart-services/core/models"
 	"github.com/nikitalystsev/BookSmart-services/errs"
 	"github.com/nikitalystsev/BookSmart-services/intfRepo"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"sort"
 	"time"
 )
 
 type ReaderRepo struct {
 	dbReader   *mongo.Collection
 	dbFavorite *mongo.Collection
+	dbBook     *mongo.Collection
 	client     *redis.Client
 	logger     *logrus.Entry
 }
 
-func NewReaderRepo(db *mongo.Database, client *redis.Client, logger *logrus.Entry) intfRepo.IReaderRepo {
+var _ intfRepo.IReaderRepo = (*ReaderRepo)(nil)
+
+// NewReaderRepo создает репозиторий читателей. Скрипты refresh-токенов работают с ключом токена и хешем сессий
+// читателя в одном вызове, поэтому в Redis Cluster эти ключи должны попадать в один слот
+func NewReaderRepo(db *mongo.Database, client *redis.Client, logger *logrus.Entry) *ReaderRepo {
 	return &ReaderRepo{
 		dbReader:   db.Collection("reader"),
 		dbFavorite: db.Collection("favorite_books"),
+		dbBook:     db.Collection("book"),
 		client:     client,
 		logger:     logger,
 	}
 }
 
-func (rr *ReaderRepo) Create(ctx context.Context, reader *models.ReaderModel) error {
-	rr.logger.Infof("inserting reader with ID: %s", reader.ID)
+func (rr *ReaderRepo) Create(ctx context.Context, reader *models.ReaderModel) (err error) {
+	ctx, span := startSpan(ctx, "reader", "Create")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("inserting reader with ID: %s", reader.ID)
+
+	ctx = transact.SessionContext(ctx)
 
-	_, err := rr.dbReader.InsertOne(ctx, rr.convertToRepoReaderModel(reader))
+	_, err = rr.dbReader.InsertOne(ctx, rr.convertToRepoReaderModel(reader))
 	if err != nil {
-		rr.logger.Errorf("error inserting reader: %v", err)
-		return err
+		return logRepoError(rr.logger, "error inserting reader", err)
 	}
 
-	rr.logger.Infof("inserted reader with ID: %s", reader.ID)
+	rr.logger.Debugf("inserted reader with ID: %s", reader.ID)
 
 	return nil
 }
 
-func (rr *ReaderRepo) GetByPhoneNumber(ctx context.Context, phoneNumber string) (*models.ReaderModel, error) {
-	rr.logger.Infof("find reader with phoneNumber: %s", phoneNumber)
+func (rr *ReaderRepo) GetByPhoneNumber(ctx context.Context, phoneNumber string) (_ *models.ReaderModel, err error) {
+	ctx, span := startSpan(ctx, "reader", "GetByPhoneNumber")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("find reader with phoneNumber: %s", phoneNumber)
+
+	ctx = transact.SessionContext(ctx)
 
 	one := rr.dbReader.FindOne(ctx, bson.M{"phone_number": phoneNumber})
 
 	if one.Err() != nil && !errors.Is(one.Err(), mongo.ErrNoDocuments) {
-		rr.logger.Errorf("error find reader by phoneNumber: %v", one.Err())
-		return nil, one.Err()
+		return nil, logRepoError(rr.logger, "error find reader by phoneNumber", one.Err())
 	}
 	if one.Err() != nil && errors.Is(one.Err(), mongo.ErrNoDocuments) {
 		rr.logger.Warnf("reader with this phoneNumber not found: %s", phoneNumber)
@@ -61,23 +82,26 @@ func (rr *ReaderRepo) GetByPhoneNumber(ctx context.Context, phoneNumber string)
 
 	var reader repomodels.ReaderModel
 	if err := one.Decode(&reader); err != nil {
-		rr.logger.Errorf("error decoding reader: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error decoding reader", err)
 	}
 
-	rr.logger.Infof("found reader with phoneNumber: %s", phoneNumber)
+	rr.logger.Debugf("found reader with phoneNumber: %s", phoneNumber)
 
 	return rr.convertToReaderModel(&reader), nil
 }
 
-func (rr *ReaderRepo) GetByID(ctx context.Context, ID uuid.UUID) (*models.ReaderModel, error) {
-	rr.logger.Infof("find reader with ID: %s", ID)
+func (rr *ReaderRepo) GetByID(ctx context.Context, ID uuid.UUID) (_ *models.ReaderModel, err error) {
+	ctx, span := startSpan(ctx, "reader", "GetByID")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("find reader with ID: %s", ID)
+
+	ctx = transact.SessionContext(ctx)
 
 	one := rr.dbReader.FindOne(ctx, bson.M{"_id": ID})
 
 	if one.Err() != nil && !errors.Is(one.Err(), mongo.ErrNoDocuments) {
-		rr.logger.Errorf("error find reader with ID: %v", one.Err())
-		return nil, one.Err()
+		return nil, logRepoError(rr.logger, "error find reader with ID", one.Err())
 	}
 	if one.Err() != nil && errors.Is(one.Err(), mongo.ErrNoDocuments) {
 		rr.logger.Warnf("reader with this ID not found: %v", ID)
@@ -86,83 +110,587 @@ func (rr *ReaderRepo) GetByID(ctx context.Context, ID uuid.UUID) (*models.Reader
 
 	var reader repomodels.ReaderModel
 	if err := one.Decode(&reader); err != nil {
-		rr.logger.Errorf("error decoding reader: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error decoding reader", err)
 	}
 
-	rr.logger.Infof("found reader with ID: %s", ID)
+	rr.logger.Debugf("found reader with ID: %s", ID)
 
 	return rr.convertToReaderModel(&reader), nil
 }
 
-func (rr *ReaderRepo) IsFavorite(ctx context.Context, readerID, bookID uuid.UUID) (bool, error) {
-	rr.logger.Infof("book with ID = %s already is favorite?", bookID)
+func (rr *ReaderRepo) IsFavorite(ctx context.Context, readerID, bookID uuid.UUID) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "favorite_books", "IsFavorite")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("book with ID = %s already is favorite?", bookID)
+
+	ctx = transact.SessionContext(ctx)
 
 	count, err := rr.dbFavorite.CountDocuments(ctx, bson.M{"reader_id": readerID, "book_id": bookID})
 	if err != nil {
-		rr.logger.Errorf("error checking favorite book: %v", err)
-		return false, err
+		return false, logRepoError(rr.logger, "error checking favorite book", err)
 	}
 
-	rr.logger.Infof("checked favorite book")
+	rr.logger.Debugf("checked favorite book")
 
 	return count > 0, nil
 }
 
-func (rr *ReaderRepo) AddToFavorites(ctx context.Context, readerID, bookID uuid.UUID) error {
-	rr.logger.Infof("reader (ID = %s) adding book (ID = %s) to favorites", readerID, bookID)
+func (rr *ReaderRepo) AddToFavorites(ctx context.Context, readerID, bookID uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "favorite_books", "AddToFavorites")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("reader (ID = %s) adding book (ID = %s) to favorites", readerID, bookID)
 
-	_, err := rr.dbFavorite.InsertOne(ctx, bson.M{"reader_id": readerID, "book_id": bookID})
+	ctx = transact.SessionContext(ctx)
+
+	_, err = rr.dbFavorite.InsertOne(ctx, bson.M{"reader_id": readerID, "book_id": bookID, "added_at": time.Now()})
+	if mongo.IsDuplicateKeyError(err) {
+		rr.logger.Warnf("book (ID = %s) already in favorites of reader (ID = %s)", bookID, readerID)
+		return repoerrs.ErrFavoriteDuplicate
+	}
 	if err != nil {
-		rr.logger.Errorf("error adding book to favorites: %v", err)
-		return err
+		return logRepoError(rr.logger, "error adding book to favorites", err)
+	}
+
+	rr.logger.Debugf("reader (ID = %s) added book (ID = %s) to favorites", readerID, bookID)
+
+	return nil
+}
+
+// RemoveFromFavorites удаляет книгу из избранного читателя
+func (rr *ReaderRepo) RemoveFromFavorites(ctx context.Context, readerID, bookID uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "favorite_books", "RemoveFromFavorites")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("reader (ID = %s) removing book (ID = %s) from favorites", readerID, bookID)
+
+	ctx = transact.SessionContext(ctx)
+
+	result, err := rr.dbFavorite.DeleteOne(ctx, bson.M{"reader_id": readerID, "book_id": bookID})
+	if err != nil {
+		return logRepoError(rr.logger, "error removing book from favorites", err)
+	}
+
+	if result.DeletedCount == 0 {
+		rr.logger.Warnf("book (ID = %s) not in favorites of reader (ID = %s)", bookID, readerID)
+		return repoerrs.ErrFavoriteDoesNotExists
 	}
 
-	rr.logger.Infof("reader (ID = %s) added book (ID = %s) to favorites", readerID, bookID)
+	rr.logger.Debugf("reader (ID = %s) removed book (ID = %s) from favorites", readerID, bookID)
 
 	return nil
 }
 
+// GetFavorites возвращает страницу избранных книг читателя, начиная с добавленных последними.
+// Нулевой limit означает все книги. Избранное без книг дает пустую страницу, а не ошибку
+func (rr *ReaderRepo) GetFavorites(ctx context.Context, readerID uuid.UUID, limit, offset uint) (_ *repodto.BookPageDTO, err error) {
+	ctx, span := startSpan(ctx, "favorite_books", "GetFavorites")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("selecting favorite books of reader with ID: %s", readerID)
+
+	ctx = transact.SessionContext(ctx)
+
+	var items bson.A
+	if offset > 0 {
+		items = append(items, bson.M{"$skip": int64(offset)})
+	}
+	if limit > 0 {
+		items = append(items, bson.M{"$limit": int64(limit)})
+	}
+	if len(items) == 0 {
+		// $facet не допускает пустой подконвейер
+		items = append(items, bson.M{"$match": bson.M{}})
+	}
+
+	// книги, удаленные из каталога, отбрасываются до подсчета общего количества
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"reader_id": readerID}}},
+		{{Key: "$sort", Value: bson.D{{Key: "added_at", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         rr.dbBook.Name(),
+			"localField":   "book_id",
+			"foreignField": "_id",
+			"as":           "book",
+		}}},
+		{{Key: "$unwind", Value: "$book"}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$book"}}},
+		{{Key: "$facet", Value: bson.M{
+			"items": items,
+			"total": bson.A{bson.M{"$count": "count"}},
+		}}},
+	}
+
+	cursor, err := rr.dbFavorite.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, logRepoError(rr.logger, "error selecting favorite books", err)
+	}
+	defer func(cursor *mongo.Cursor, ctx context.Context) {
+		if err := cursor.Close(ctx); err != nil {
+			rr.logger.Warnf("error closing cursor: %v", err)
+		}
+	}(cursor, ctx)
+
+	var results []bookPageResult
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, logRepoError(rr.logger, "error decoding favorite books", err)
+	}
+
+	page := &repodto.BookPageDTO{Books: []*models.BookModel{}}
+	if len(results) == 0 {
+		return page, nil
+	}
+
+	result := results[0]
+	if len(result.Total) > 0 {
+		page.Total = result.Total[0].Count
+	}
+	page.Books = make([]*models.BookModel, len(result.Items))
+	for i, book := range result.Items {
+		page.Books[i] = convertToBookModel(book)
+	}
+	page.HasMore = int64(offset)+int64(len(page.Books)) < page.Total
+
+	rr.logger.Debugf("found %d favorite books of %d", len(page.Books), page.Total)
+
+	return page, nil
+}
+
+// CountFavoritesByBookID возвращает количество читателей, добавивших книгу в избранное
+func (rr *ReaderRepo) CountFavoritesByBookID(ctx context.Context, bookID uuid.UUID) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "favorite_books", "CountFavoritesByBookID")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("counting favorites of book with ID: %s", bookID)
+
+	ctx = transact.SessionContext(ctx)
+
+	count, err := rr.dbFavorite.CountDocuments(ctx, bson.M{"book_id": bookID})
+	if err != nil {
+		return 0, logRepoError(rr.logger, "error counting favorites", err)
+	}
+
+	rr.logger.Debugf("counted %d favorites of book with ID: %s", count, bookID)
+
+	return count, nil
+}
+
+const (
+	refreshTokenReaderPrefix  = "refresh_token:reader:"
+	refreshTokenRotatedPrefix = "refresh_token:rotated:"
+)
+
+// refreshSession -- метаданные refresh-токена в хеше активных токенов читателя
+type refreshSession struct {
+	Device    string    `json:"device"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// Ключ токена -- сам токен со значением readerID, как и до появления хеша сессий читателя.
+// Хеш живет не меньше самого долгого токена, нулевой ttl (ARGV[3], в миллисекундах) означает токен без срока
+var saveRefreshTokenScript = redis.NewScript(`
+local ttl = tonumber(ARGV[3])
+if ttl > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ttl)
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+local fresh = redis.call('EXISTS', KEYS[2]) == 0
+redis.call('HSET', KEYS[2], KEYS[1], ARGV[2])
+local pttl = redis.call('PTTL', KEYS[2])
+if ttl == 0 then
+	redis.call('PERSIST', KEYS[2])
+elseif fresh or (pttl >= 0 and pttl < ttl) then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+return 1
+`)
+
+// Старый токен удаляется только если все еще принадлежит читателю ARGV[1]. Вместо него остается метка ротации,
+// по которой повторное предъявление старого токена распознается как кража. -1 -- токен уже был заменен, 0 -- не найден
+var rotateRefreshTokenScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	if redis.call('EXISTS', KEYS[3]) == 1 then
+		return -1
+	end
+	return 0
+end
+local ttl = tonumber(ARGV[3])
+redis.call('DEL', KEYS[1])
+redis.call('HDEL', KEYS[4], KEYS[1])
+if ttl > 0 then
+	redis.call('SET', KEYS[3], ARGV[1], 'PX', ttl)
+	redis.call('SET', KEYS[2], ARGV[1], 'PX', ttl)
+else
+	redis.call('SET', KEYS[3], ARGV[1])
+	redis.call('SET', KEYS[2], ARGV[1])
+end
+local fresh = redis.call('EXISTS', KEYS[4]) == 0
+redis.call('HSET', KEYS[4], KEYS[2], ARGV[2])
+local pttl = redis.call('PTTL', KEYS[4])
+if ttl == 0 then
+	redis.call('PERSIST', KEYS[4])
+elseif fresh or (pttl >= 0 and pttl < ttl) then
+	redis.call('PEXPIRE', KEYS[4], ttl)
+end
+return 1
+`)
+
+var revokeRefreshTokenScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('HDEL', KEYS[2], KEYS[1])
+return 1
+`)
+
+// KEYS[1] -- хеш сессий читателя, остальные ключи -- токены, прочитанные из него заранее
+var revokeRefreshTokensScript = redis.NewScript(`
+for i = 2, #KEYS do
+	redis.call('DEL', KEYS[i])
+	redis.call('HDEL', KEYS[1], KEYS[i])
+end
+return #KEYS - 1
+`)
+
 func (rr *ReaderRepo) SaveRefreshToken(ctx context.Context, id uuid.UUID, token string, ttl time.Duration) error {
-	rr.logger.Infof("saving refresh token in redis")
+	return rr.SaveRefreshTokenWithDevice(ctx, id, token, "", ttl)
+}
+
+// SaveRefreshTokenWithDevice сохраняет refresh-токен читателя и добавляет его в список активных сессий читателя
+func (rr *ReaderRepo) SaveRefreshTokenWithDevice(ctx context.Context, id uuid.UUID, token, device string, ttl time.Duration) (err error) {
+	ctx, span := startSpan(ctx, "refresh_token", "SaveRefreshToken")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("saving refresh token in redis")
+
+	ttlMs, err := rr.getRefreshTokenTTL(ttl)
+	if err != nil {
+		rr.logger.Warnf("invalid refresh token ttl: %s", ttl)
+		return err
+	}
+
+	session, err := rr.newRefreshSession(device, ttl)
+	if err != nil {
+		rr.logger.Errorf("error encoding refresh session: %v", err)
+		return err
+	}
+
+	keys := []string{token, refreshTokenReaderPrefix + id.String()}
+	err = saveRefreshTokenScript.Run(ctx, rr.client, keys, id.String(), session, ttlMs).Err()
+	if err != nil {
+		return logRepoError(rr.logger, "error saving refresh token", err)
+	}
+
+	rr.logger.Debugf("refresh token saved in redis")
+
+	return nil
+}
+
+// RotateRefreshToken атомарно заменяет oldToken на newToken и возвращает ID читателя. Повторное предъявление
+// уже замененного токена считается кражей: все сессии читателя отзываются и возвращается ErrRefreshTokenReused
+func (rr *ReaderRepo) RotateRefreshToken(ctx context.Context, oldToken, newToken, device string, ttl time.Duration) (_ uuid.UUID, err error) {
+	ctx, span := startSpan(ctx, "refresh_token", "RotateRefreshToken")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("rotating refresh token")
+
+	ttlMs, err := rr.getRefreshTokenTTL(ttl)
+	if err != nil {
+		rr.logger.Warnf("invalid refresh token ttl: %s", ttl)
+		return uuid.Nil, err
+	}
+
+	readerID, rotated, err := rr.getRefreshTokenOwner(ctx, oldToken)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if rotated {
+		return uuid.Nil, rr.revokeReusedRefreshToken(ctx, readerID)
+	}
 
-	err := rr.client.Set(ctx, token, id.String(), ttl).Err()
+	session, err := rr.newRefreshSession(device, ttl)
+	if err != nil {
+		rr.logger.Errorf("error encoding refresh session: %v", err)
+		return uuid.Nil, err
+	}
+
+	keys := []string{oldToken, newToken, refreshTokenRotatedPrefix + oldToken, refreshTokenReaderPrefix + readerID.String()}
+	result, err := rotateRefreshTokenScript.Run(ctx, rr.client, keys, readerID.String(), session, ttlMs).Int()
+	if err != nil {
+		return uuid.Nil, logRepoError(rr.logger, "error rotating refresh token", err)
+	}
+
+	switch result {
+	case -1:
+		// токен заменили между чтением владельца и ротацией
+		return uuid.Nil, rr.revokeReusedRefreshToken(ctx, readerID)
+	case 0:
+		rr.logger.Warnf("refresh token not found")
+		return uuid.Nil, repoerrs.ErrRefreshTokenDoesNotExists
+	}
+
+	rr.logger.Debugf("rotated refresh token of reader with ID: %s", readerID)
+
+	return readerID, nil
+}
+
+// RevokeRefreshToken отзывает один refresh-токен
+func (rr *ReaderRepo) RevokeRefreshToken(ctx context.Context, token string) (err error) {
+	ctx, span := startSpan(ctx, "refresh_token", "RevokeRefreshToken")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("revoking refresh token")
+
+	readerID, rotated, err := rr.getRefreshTokenOwner(ctx, token)
 	if err != nil {
-		rr.logger.Errorf("error saving refresh token: %v", err)
 		return err
 	}
+	if rotated {
+		rr.logger.Warnf("refresh token already rotated")
+		return repoerrs.ErrRefreshTokenDoesNotExists
+	}
 
-	rr.logger.Infof("refresh token saved in redis")
+	keys := []string{token, refreshTokenReaderPrefix + readerID.String()}
+	revoked, err := revokeRefreshTokenScript.Run(ctx, rr.client, keys, readerID.String()).Int()
+	if err != nil {
+		return logRepoError(rr.logger, "error revoking refresh token", err)
+	}
+
+	if revoked == 0 {
+		rr.logger.Warnf("refresh token not found")
+		return repoerrs.ErrRefreshTokenDoesNotExists
+	}
+
+	rr.logger.Debugf("revoked refresh token of reader with ID: %s", readerID)
 
 	return nil
 }
 
-func (rr *ReaderRepo) GetByRefreshToken(ctx context.Context, token string) (*models.ReaderModel, error) {
-	rr.logger.Infof("getting reader by refresh token: %s", token)
+// RevokeAllForReader отзывает все refresh-токены читателя и возвращает их количество
+func (rr *ReaderRepo) RevokeAllForReader(ctx context.Context, readerID uuid.UUID) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "refresh_token", "RevokeAllForReader")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("revoking all refresh tokens of reader with ID: %s", readerID)
+
+	key := refreshTokenReaderPrefix + readerID.String()
+
+	// токены, сохраненные между чтением хеша и удалением, отзываются следующим проходом
+	var revoked int64
+	for {
+		tokens, err := rr.client.HKeys(ctx, key).Result()
+		if err != nil {
+			return revoked, logRepoError(rr.logger, "error find refresh sessions", err)
+		}
+		if len(tokens) == 0 {
+			break
+		}
+
+		count, err := revokeRefreshTokensScript.Run(ctx, rr.client, append([]string{key}, tokens...)).Int64()
+		if err != nil {
+			return revoked, logRepoError(rr.logger, "error revoking refresh tokens", err)
+		}
+		revoked += count
+	}
+
+	rr.logger.Debugf("revoked %d refresh tokens of reader with ID: %s", revoked, readerID)
+
+	return revoked, nil
+}
+
+// RevokeRefreshSession отзывает сессию читателя по ID из GetRefreshSessions
+func (rr *ReaderRepo) RevokeRefreshSession(ctx context.Context, readerID uuid.UUID, sessionID string) (err error) {
+	ctx, span := startSpan(ctx, "refresh_token", "RevokeRefreshSession")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("revoking refresh session %s of reader with ID: %s", sessionID, readerID)
+
+	key := refreshTokenReaderPrefix + readerID.String()
+	tokens, err := rr.client.HKeys(ctx, key).Result()
+	if err != nil {
+		return logRepoError(rr.logger, "error find refresh sessions", err)
+	}
+
+	for _, token := range tokens {
+		if rr.getRefreshSessionID(token) != sessionID {
+			continue
+		}
+
+		revoked, err := revokeRefreshTokenScript.Run(ctx, rr.client, []string{token, key}, readerID.String()).Int()
+		if err != nil {
+			return logRepoError(rr.logger, "error revoking refresh token", err)
+		}
+		if revoked == 0 {
+			break
+		}
+
+		rr.logger.Debugf("revoked refresh session %s of reader with ID: %s", sessionID, readerID)
+
+		return nil
+	}
+
+	rr.logger.Warnf("refresh session not found: %s", sessionID)
+
+	return repoerrs.ErrRefreshTokenDoesNotExists
+}
+
+// GetRefreshSessions возвращает активные сессии читателя. Истекшие записи удаляются из хеша сессий.
+// Читатель без сессий дает пустой список, а не ошибку
+func (rr *ReaderRepo) GetRefreshSessions(ctx context.Context, readerID uuid.UUID) (_ []*repodto.RefreshSessionDTO, err error) {
+	ctx, span := startSpan(ctx, "refresh_token", "GetRefreshSessions")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("find refresh sessions of reader with ID: %s", readerID)
+
+	key := refreshTokenReaderPrefix + readerID.String()
+	entries, err := rr.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, logRepoError(rr.logger, "error find refresh sessions", err)
+	}
+
+	now := time.Now()
+	sessions := make([]*repodto.RefreshSessionDTO, 0, len(entries))
+	var expired []string
+	for token, data := range entries {
+		var session refreshSession
+		if err = json.Unmarshal([]byte(data), &session); err != nil {
+			rr.logger.Errorf("error decoding refresh session: %v", err)
+			return nil, err
+		}
+
+		if !session.ExpiresAt.IsZero() && !session.ExpiresAt.After(now) {
+			expired = append(expired, token)
+			continue
+		}
+
+		sessions = append(sessions, &repodto.RefreshSessionDTO{
+			ID:        rr.getRefreshSessionID(token),
+			ReaderID:  readerID,
+			Device:    session.Device,
+			CreatedAt: session.CreatedAt,
+			ExpiresAt: session.ExpiresAt,
+		})
+	}
+
+	if len(expired) > 0 {
+		if err = rr.client.HDel(ctx, key, expired...).Err(); err != nil {
+			rr.logger.Warnf("error removing expired refresh sessions: %v", err)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.After(sessions[j].CreatedAt) })
+
+	rr.logger.Debugf("found %d refresh sessions of reader with ID: %s", len(sessions), readerID)
+
+	return sessions, nil
+}
+
+// getRefreshTokenOwner возвращает ID читателя, которому принадлежит токен. rotated означает,
+// что токен уже заменен при ротации и найден только по метке ротации
+func (rr *ReaderRepo) getRefreshTokenOwner(ctx context.Context, token string) (uuid.UUID, bool, error) {
+	rotated := false
+
+	readerIDStr, err := rr.client.Get(ctx, token).Result()
+	if errors.Is(err, redis.Nil) {
+		rotated = true
+		readerIDStr, err = rr.client.Get(ctx, refreshTokenRotatedPrefix+token).Result()
+	}
+	if errors.Is(err, redis.Nil) {
+		rr.logger.Warnf("refresh token not found")
+		return uuid.Nil, false, repoerrs.ErrRefreshTokenDoesNotExists
+	}
+	if err != nil {
+		return uuid.Nil, false, logRepoError(rr.logger, "error getting refresh token owner", err)
+	}
+
+	readerID, err := uuid.Parse(readerIDStr)
+	if err != nil {
+		rr.logger.Errorf("error parsing readerID by refresh token: %v", err)
+		return uuid.Nil, false, err
+	}
+
+	return readerID, rotated, nil
+}
+
+// revokeReusedRefreshToken отзывает все сессии читателя, чей замененный токен предъявлен повторно
+func (rr *ReaderRepo) revokeReusedRefreshToken(ctx context.Context, readerID uuid.UUID) error {
+	rr.logger.Warnf("reuse of rotated refresh token of reader with ID: %s, revoking all sessions", readerID)
+
+	if _, err := rr.RevokeAllForReader(ctx, readerID); err != nil {
+		return err
+	}
+
+	return repoerrs.ErrRefreshTokenReused
+}
+
+func (rr *ReaderRepo) newRefreshSession(device string, ttl time.Duration) (string, error) {
+	session := refreshSession{Device: device, CreatedAt: time.Now()}
+	if ttl > 0 {
+		session.ExpiresAt = session.CreatedAt.Add(ttl)
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// getRefreshTokenTTL переводит ttl в миллисекунды для скриптов. Нулевой ttl, как и в redis Set, означает токен без срока.
+// Срок меньше миллисекунды округляется вверх, чтобы не стать бессрочным
+func (rr *ReaderRepo) getRefreshTokenTTL(ttl time.Duration) (int64, error) {
+	if ttl < 0 {
+		return 0, repoerrs.ErrInvalidRefreshTokenTTL
+	}
+
+	ms := ttl.Milliseconds()
+	if ttl%time.Millisecond != 0 {
+		ms++
+	}
+
+	return ms, nil
+}
+
+// getRefreshSessionID -- непрозрачный ID сессии, по которому нельзя восстановить токен
+func (rr *ReaderRepo) getRefreshSessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func (rr *ReaderRepo) GetByRefreshToken(ctx context.Context, token string) (_ *models.ReaderModel, err error) {
+	ctx, span := startSpan(ctx, "reader", "GetByRefreshToken")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("getting reader by refresh session: %s", rr.getRefreshSessionID(token))
+
+	ctx = transact.SessionContext(ctx)
 
 	var readerID uuid.UUID
 
 	readerIDStr, err := rr.client.Get(ctx, token).Result()
 	if err != nil && !errors.Is(err, redis.Nil) {
-		rr.logger.Errorf("error getting reader by refresh token: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error getting reader by refresh token", err)
 	}
 	if err != nil && errors.Is(err, redis.Nil) {
-		rr.logger.Errorf("reader with this refresh token not found: %s", token)
+		rr.logger.Errorf("reader with this refresh session not found: %s", rr.getRefreshSessionID(token))
 		return nil, errs.ErrReaderDoesNotExists
 	}
 
 	readerID, err = uuid.Parse(readerIDStr)
 	if err != nil {
-		rr.logger.Errorf("error parsing readerID by refresh token: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error parsing readerID by refresh token", err)
 	}
 
 	one := rr.dbReader.FindOne(ctx, bson.M{"_id": readerID})
 
 	if one.Err() != nil && !errors.Is(one.Err(), mongo.ErrNoDocuments) {
-		rr.logger.Errorf("error find reader with ID: %v", one.Err())
-		return nil, one.Err()
+		return nil, logRepoError(rr.logger, "error find reader with ID", one.Err())
 	}
 	if one.Err() != nil && errors.Is(one.Err(), mongo.ErrNoDocuments) {
 		rr.logger.Warnf("reader with this ID not found: %v", readerID)
@@ -171,11 +699,10 @@ func (rr *ReaderRepo) GetByRefreshToken(ctx context.Context, token string) (*mod
 
 	var reader repomodels.ReaderModel
 	if err = one.Decode(&reader); err != nil {
-		rr.logger.Errorf("error decoding reader: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error decoding reader", err)
 	}
 
-	rr.logger.Infof("getting reader by refresh token: %v", token)
+	rr.logger.Debugf("got reader by refresh session: %s", rr.getRefreshSessionID(token))
 
 	return rr.convertToReaderModel(&reader), nil
 }
@@ -0,0 +1,98 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	repoerrs "github.com/nikitalystsev/BookSmart-repo-mongo/core/errs"
+	"github.com/nikitalystsev/BookSmart-services/errs"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net"
+)
+
+// writeConflictCode -- код ошибки WriteConflict сервера MongoDB
+const writeConflictCode = 112
+
+// errorClasses -- типизированные ошибки репозитория и их классы для логирования и метрик
+var errorClasses = []struct {
+	err   error
+	class string
+}{
+	{repoerrs.ErrCanceled, "canceled"},
+	{repoerrs.ErrTimeout, "timeout"},
+	{repoerrs.ErrNetwork, "network"},
+	{repoerrs.ErrDuplicateKey, "duplicate_key"},
+	{repoerrs.ErrWriteConflict, "write_conflict"},
+	{repoerrs.ErrVersionConflict, "version_conflict"},
+	{repoerrs.ErrFavoriteDoesNotExists, "not_found"},
+	{repoerrs.ErrRefreshTokenDoesNotExists, "not_found"},
+	{repoerrs.ErrRefreshTokenReused, "token_reuse"},
+	{errs.ErrBookDoesNotExists, "not_found"},
+	{errs.ErrLibCardDoesNotExists, "not_found"},
+	{errs.ErrRatingDoesNotExists, "not_found"},
+	{errs.ErrReaderDoesNotExists, "not_found"},
+	{errs.ErrReservationDoesNotExists, "not_found"},
+}
+
+// translateError оборачивает ошибку драйвера в типизированную ошибку репозитория.
+// Исходная ошибка остается в цепочке, ошибки других видов возвращаются без изменений
+func translateError(err error) error {
+	if typed := classifyError(err); typed != nil {
+		return fmt.Errorf("%w: %w", typed, err)
+	}
+
+	return err
+}
+
+// logRepoError переводит ошибку в типизированную, пишет ее в лог вместе с классом и возвращает переведенную
+func logRepoError(logger *logrus.Entry, msg string, err error) error {
+	err = translateError(err)
+	logger.WithField("error_class", errorClass(err)).Errorf("%s: %v", msg, err)
+
+	return err
+}
+
+// errorClass возвращает класс ошибки для логирования
+func errorClass(err error) string {
+	for _, ec := range errorClasses {
+		if errors.Is(err, ec.err) {
+			return ec.class
+		}
+	}
+
+	return "other"
+}
+
+func classifyError(err error) error {
+	for _, ec := range errorClasses {
+		if errors.Is(err, ec.err) {
+			return nil // уже переведена
+		}
+	}
+
+	var netErr net.Error
+	var serverErr mongo.ServerError
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.Canceled):
+		return repoerrs.ErrCanceled
+	case errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err):
+		return repoerrs.ErrTimeout
+	case mongo.IsNetworkError(err):
+		return repoerrs.ErrNetwork
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return repoerrs.ErrTimeout
+		}
+		return repoerrs.ErrNetwork
+	case mongo.IsDuplicateKeyError(err):
+		return repoerrs.ErrDuplicateKey
+	case errors.As(err, &serverErr) && serverErr.HasErrorCode(writeConflictCode):
+		return repoerrs.ErrWriteConflict
+	}
+
+	return nil
+}
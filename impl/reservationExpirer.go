@@ -0,0 +1,52 @@
+package impl
+
+import (
+	"context"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/pkg/sweeper"
+	"github.com/nikitalystsev/BookSmart-services/impl"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+// ReservationExpirer переводит просроченные выданные и продленные брони в состояние Expired
+type ReservationExpirer struct {
+	db     *mongo.Collection
+	logger *logrus.Entry
+}
+
+func NewReservationExpirer(db *mongo.Database, logger *logrus.Entry) *ReservationExpirer {
+	return &ReservationExpirer{db: db.Collection("reservation"), logger: logger}
+}
+
+// ExpireOverdue помечает истекшими брони с return_date раньше now и возвращает количество измененных
+func (re *ReservationExpirer) ExpireOverdue(ctx context.Context, now time.Time) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "reservation", "ExpireOverdue")
+	defer func() { span.end(err) }()
+
+	re.logger.Debugf("expiring reservations overdue at %s", now)
+
+	filter := bson.M{
+		"state":       bson.M{"$in": []string{impl.ReservationIssued, impl.ReservationExtended}},
+		"return_date": bson.M{"$lt": now},
+	}
+	update := bson.M{
+		"$set": bson.M{"state": impl.ReservationExpired},
+		"$inc": bson.M{"version": 1},
+	}
+
+	result, err := re.db.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, logRepoError(re.logger, "error expiring reservations", err)
+	}
+
+	re.logger.Infof("expired %d reservations", result.ModifiedCount)
+
+	return result.ModifiedCount, nil
+}
+
+// Sweeper возвращает фоновую задачу, вызывающую ExpireOverdue каждые interval
+func (re *ReservationExpirer) Sweeper(interval time.Duration) *sweeper.Sweeper {
+	return sweeper.NewSweeper("reservation expiry", interval, re.ExpireOverdue, re.logger)
+}
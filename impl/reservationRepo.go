@@ -3,9 +3,10 @@ package impl
 import (
 	"context"
 	"errors"
-	"fmt"
 	"github.com/google/uuid"
+	repoerrs "github.com/nikitalystsev/BookSmart-repo-mongo/core/errs"
 	repomodels "github.com/nikitalystsev/BookSmart-repo-mongo/core/models"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/pkg/transact"
 	"github.com/nikitalystsev/BookSmart-services/core/models"
 	"github.com/nikitalystsev/BookSmart-services/errs"
 	"github.com/nikitalystsev/BookSmart-services/impl"
@@ -21,50 +22,53 @@ type ReservationRepo struct {
 	logger *logrus.Entry
 }
 
-func NewReservationRepo(db *mongo.Database, logger *logrus.Entry) intfRepo.IReservationRepo {
+var _ intfRepo.IReservationRepo = (*ReservationRepo)(nil)
+
+func NewReservationRepo(db *mongo.Database, logger *logrus.Entry) *ReservationRepo {
 	return &ReservationRepo{db: db.Collection("reservation"), logger: logger}
 }
 
-func (rr *ReservationRepo) Create(ctx context.Context, reservation *models.ReservationModel) error {
-	rr.logger.Infof("inserting reservation with ID: %s", reservation.ID)
+func (rr *ReservationRepo) Create(ctx context.Context, reservation *models.ReservationModel) (err error) {
+	ctx, span := startSpan(ctx, "reservation", "Create")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("inserting reservation with ID: %s", reservation.ID)
+
+	ctx = transact.SessionContext(ctx)
 
-	_, err := rr.db.InsertOne(ctx, rr.convertToRepoReservationModel(reservation))
+	_, err = rr.db.InsertOne(ctx, rr.convertToRepoReservationModel(reservation))
 	if err != nil {
-		rr.logger.Errorf("error inserting reservation: %v", err)
-		return err
+		return logRepoError(rr.logger, "error inserting reservation", err)
 	}
 
-	rr.logger.Infof("inserted reservation with ID: %s", reservation.ID)
+	rr.logger.Debugf("inserted reservation with ID: %s", reservation.ID)
 
 	return nil
 }
 
-func (rr *ReservationRepo) GetByReaderAndBook(ctx context.Context, readerID, bookID uuid.UUID) ([]*models.ReservationModel, error) {
-	rr.logger.Infof("find reservations with readerID и bookID: %s и %s", readerID, bookID)
+func (rr *ReservationRepo) GetByReaderAndBook(ctx context.Context, readerID, bookID uuid.UUID) (_ []*models.ReservationModel, err error) {
+	ctx, span := startSpan(ctx, "reservation", "GetByReaderAndBook")
+	defer func() { span.end(err) }()
 
-	if err := rr.updateReservationStates(ctx); err != nil {
-		rr.logger.Errorf("error updating reservations status: %v", err)
-		return nil, err
-	}
+	rr.logger.Debugf("find reservations with readerID и bookID: %s и %s", readerID, bookID)
+
+	ctx = transact.SessionContext(ctx)
 
 	cursor, err := rr.db.Find(ctx, bson.M{"reader_id": readerID, "book_id": bookID})
 
 	if err != nil {
-		rr.logger.Errorf("error selecting reservations: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error selecting reservations", err)
 	}
 
 	defer func(cursor *mongo.Cursor, ctx context.Context) {
-		err = cursor.Close(ctx)
-		if err != nil {
-			fmt.Println("error close cursor")
+		if err := cursor.Close(ctx); err != nil {
+			rr.logger.Warnf("error closing cursor: %v", err)
 		}
 	}(cursor, ctx)
 
 	var coreReservations []*repomodels.ReservationModel
 	if err = cursor.All(ctx, &coreReservations); err != nil {
-		rr.logger.Printf("error decoding reservations: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error decoding reservations", err)
 	}
 
 	if len(coreReservations) == 0 {
@@ -72,7 +76,7 @@ func (rr *ReservationRepo) GetByReaderAndBook(ctx context.Context, readerID, boo
 		return nil, errs.ErrReservationDoesNotExists
 	}
 
-	rr.logger.Infof("found reservation with readerID и bookID: %s и %s", readerID, bookID)
+	rr.logger.Debugf("found reservation with readerID и bookID: %s и %s", readerID, bookID)
 
 	reservations := make([]*models.ReservationModel, len(coreReservations))
 	for i, coreReservation := range coreReservations {
@@ -82,19 +86,18 @@ func (rr *ReservationRepo) GetByReaderAndBook(ctx context.Context, readerID, boo
 	return reservations, nil
 }
 
-func (rr *ReservationRepo) GetByID(ctx context.Context, ID uuid.UUID) (*models.ReservationModel, error) {
-	rr.logger.Infof("find reservation with ID: %s", ID)
+func (rr *ReservationRepo) GetByID(ctx context.Context, ID uuid.UUID) (_ *models.ReservationModel, err error) {
+	ctx, span := startSpan(ctx, "reservation", "GetByID")
+	defer func() { span.end(err) }()
 
-	if err := rr.updateReservationStates(ctx); err != nil {
-		rr.logger.Errorf("error updating reservations status: %v", err)
-		return nil, err
-	}
+	rr.logger.Debugf("find reservation with ID: %s", ID)
+
+	ctx = transact.SessionContext(ctx)
 
 	one := rr.db.FindOne(ctx, bson.M{"_id": ID})
 
 	if one.Err() != nil && !errors.Is(one.Err(), mongo.ErrNoDocuments) {
-		rr.logger.Errorf("error find reservation: %v", one.Err())
-		return nil, one.Err()
+		return nil, logRepoError(rr.logger, "error find reservation", one.Err())
 	}
 	if one.Err() != nil && errors.Is(one.Err(), mongo.ErrNoDocuments) {
 		rr.logger.Warnf("reservation with this ID not found: %s", ID)
@@ -103,23 +106,22 @@ func (rr *ReservationRepo) GetByID(ctx context.Context, ID uuid.UUID) (*models.R
 
 	var reservation repomodels.ReservationModel
 	if err := one.Decode(&reservation); err != nil {
-		rr.logger.Errorf("error decoding reservation: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error decoding reservation", err)
 	}
 
-	rr.logger.Infof("found reservation with ID: %s", ID)
+	rr.logger.Debugf("found reservation with ID: %s", ID)
 
 	return rr.convertToReservationModel(&reservation), nil
 }
 
 // GetByBookID TODO добавить в схемы
-func (rr *ReservationRepo) GetByBookID(ctx context.Context, bookID uuid.UUID) ([]*models.ReservationModel, error) {
-	rr.logger.Infof("find reservation with bookID: %s", bookID)
+func (rr *ReservationRepo) GetByBookID(ctx context.Context, bookID uuid.UUID) (_ []*models.ReservationModel, err error) {
+	ctx, span := startSpan(ctx, "reservation", "GetByBookID")
+	defer func() { span.end(err) }()
 
-	if err := rr.updateReservationStates(ctx); err != nil {
-		rr.logger.Errorf("error updating reservations status: %v", err)
-		return nil, err
-	}
+	rr.logger.Debugf("find reservation with bookID: %s", bookID)
+
+	ctx = transact.SessionContext(ctx)
 
 	filter := bson.M{
 		"book_id": bookID,
@@ -127,20 +129,17 @@ func (rr *ReservationRepo) GetByBookID(ctx context.Context, bookID uuid.UUID) ([
 
 	cursor, err := rr.db.Find(ctx, filter)
 	if err != nil {
-		rr.logger.Errorf("error find expired reservations: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error find expired reservations", err)
 	}
 	defer func(cursor *mongo.Cursor, ctx context.Context) {
-		err = cursor.Close(ctx)
-		if err != nil {
-			fmt.Println("error close cursor")
+		if err := cursor.Close(ctx); err != nil {
+			rr.logger.Warnf("error closing cursor: %v", err)
 		}
 	}(cursor, ctx)
 
 	var coreReservations []*repomodels.ReservationModel
 	if err = cursor.All(ctx, &coreReservations); err != nil {
-		rr.logger.Printf("error decoding reservations: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error decoding reservations", err)
 	}
 
 	if len(coreReservations) == 0 {
@@ -148,7 +147,7 @@ func (rr *ReservationRepo) GetByBookID(ctx context.Context, bookID uuid.UUID) ([
 		return nil, errs.ErrReservationDoesNotExists
 	}
 
-	rr.logger.Infof("found reservation with bookID: %s", bookID)
+	rr.logger.Debugf("found reservation with bookID: %s", bookID)
 
 	reservations := make([]*models.ReservationModel, len(coreReservations))
 	for i, coreReservation := range coreReservations {
@@ -158,23 +157,18 @@ func (rr *ReservationRepo) GetByBookID(ctx context.Context, bookID uuid.UUID) ([
 	return reservations, nil
 }
 
-func (rr *ReservationRepo) Update(ctx context.Context, reservation *models.ReservationModel) error {
-	rr.logger.Infof("updating reservation with ID: %s", reservation.ID)
+// Update обновляет бронь без проверки версии. Для оптимистичной блокировки -- GetByIDWithVersion и UpdateWithVersion
+func (rr *ReservationRepo) Update(ctx context.Context, reservation *models.ReservationModel) (err error) {
+	ctx, span := startSpan(ctx, "reservation", "Update")
+	defer func() { span.end(err) }()
 
-	updateData := bson.M{
-		"$set": bson.M{
-			"reader_id":   reservation.ReaderID,
-			"book_id":     reservation.BookID,
-			"issue_date":  reservation.IssueDate,
-			"return_date": reservation.ReturnDate,
-			"state":       reservation.State,
-		},
-	}
+	rr.logger.Debugf("updating reservation with ID: %s", reservation.ID)
+
+	ctx = transact.SessionContext(ctx)
 
-	one, err := rr.db.UpdateOne(ctx, bson.M{"_id": reservation.ID}, updateData)
+	one, err := rr.db.UpdateOne(ctx, bson.M{"_id": reservation.ID}, rr.getUpdateData(reservation))
 	if err != nil {
-		rr.logger.Errorf("error updating reservation with ID: %v", err)
-		return err
+		return logRepoError(rr.logger, "error updating reservation with ID", err)
 	}
 
 	if one.MatchedCount == 0 {
@@ -182,18 +176,73 @@ func (rr *ReservationRepo) Update(ctx context.Context, reservation *models.Reser
 		return errs.ErrReservationDoesNotExists
 	}
 
-	rr.logger.Infof("updated reservation with ID: %s", reservation.ID)
+	rr.logger.Debugf("updated reservation with ID: %s", reservation.ID)
 
 	return nil
 }
 
-func (rr *ReservationRepo) GetExpiredByReaderID(ctx context.Context, readerID uuid.UUID) ([]*models.ReservationModel, error) {
-	rr.logger.Infof("find expired reservations with readerID: %s", readerID)
+// GetByIDWithVersion возвращает бронь вместе с ее текущей версией для последующего UpdateWithVersion
+func (rr *ReservationRepo) GetByIDWithVersion(ctx context.Context, ID uuid.UUID) (_ *models.ReservationModel, _ int64, err error) {
+	ctx, span := startSpan(ctx, "reservation", "GetByIDWithVersion")
+	defer func() { span.end(err) }()
 
-	if err := rr.updateReservationStates(ctx); err != nil {
-		rr.logger.Errorf("error updating reservations status: %v", err)
-		return nil, err
+	rr.logger.Debugf("find reservation with version by ID: %s", ID)
+
+	ctx = transact.SessionContext(ctx)
+
+	one := rr.db.FindOne(ctx, bson.M{"_id": ID})
+
+	if one.Err() != nil && !errors.Is(one.Err(), mongo.ErrNoDocuments) {
+		return nil, 0, logRepoError(rr.logger, "error find reservation", one.Err())
 	}
+	if one.Err() != nil && errors.Is(one.Err(), mongo.ErrNoDocuments) {
+		rr.logger.Warnf("reservation with this ID not found: %s", ID)
+		return nil, 0, errs.ErrReservationDoesNotExists
+	}
+
+	var reservation repomodels.ReservationModel
+	if err := one.Decode(&reservation); err != nil {
+		return nil, 0, logRepoError(rr.logger, "error decoding reservation", err)
+	}
+
+	rr.logger.Debugf("found reservation with ID: %s, version: %d", ID, reservation.Version)
+
+	return rr.convertToReservationModel(&reservation), reservation.Version, nil
+}
+
+// UpdateWithVersion обновляет бронь, только если ее версия в БД равна version.
+// Если бронь уже изменил кто-то другой, возвращается repoerrs.ErrReservationVersionConflict
+func (rr *ReservationRepo) UpdateWithVersion(ctx context.Context, reservation *models.ReservationModel, version int64) (err error) {
+	ctx, span := startSpan(ctx, "reservation", "UpdateWithVersion")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("updating reservation with ID: %s, expected version: %d", reservation.ID, version)
+
+	ctx = transact.SessionContext(ctx)
+
+	filter := getVersionFilter(reservation.ID, version)
+
+	one, err := rr.db.UpdateOne(ctx, filter, rr.getUpdateData(reservation))
+	if err != nil {
+		return logRepoError(rr.logger, "error updating reservation with ID", err)
+	}
+
+	if one.MatchedCount == 0 {
+		return rr.checkVersionConflictReason(ctx, reservation.ID)
+	}
+
+	rr.logger.Debugf("updated reservation with ID: %s", reservation.ID)
+
+	return nil
+}
+
+func (rr *ReservationRepo) GetExpiredByReaderID(ctx context.Context, readerID uuid.UUID) (_ []*models.ReservationModel, err error) {
+	ctx, span := startSpan(ctx, "reservation", "GetExpiredByReaderID")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("find expired reservations with readerID: %s", readerID)
+
+	ctx = transact.SessionContext(ctx)
 
 	filter := bson.M{
 		"$or": []bson.M{
@@ -205,20 +254,17 @@ func (rr *ReservationRepo) GetExpiredByReaderID(ctx context.Context, readerID uu
 
 	cursor, err := rr.db.Find(ctx, filter)
 	if err != nil {
-		rr.logger.Errorf("error find expired reservations: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error find expired reservations", err)
 	}
 	defer func(cursor *mongo.Cursor, ctx context.Context) {
-		err = cursor.Close(ctx)
-		if err != nil {
-			fmt.Println("error close cursor")
+		if err := cursor.Close(ctx); err != nil {
+			rr.logger.Warnf("error closing cursor: %v", err)
 		}
 	}(cursor, ctx)
 
 	var coreReservations []*repomodels.ReservationModel
 	if err = cursor.All(ctx, &coreReservations); err != nil {
-		rr.logger.Printf("error decoding reservations: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error decoding reservations", err)
 	}
 
 	if len(coreReservations) == 0 {
@@ -226,7 +272,7 @@ func (rr *ReservationRepo) GetExpiredByReaderID(ctx context.Context, readerID uu
 		return nil, errs.ErrReservationDoesNotExists
 	}
 
-	rr.logger.Infof("found %d expired reservations with readerID %s", len(coreReservations), readerID)
+	rr.logger.Debugf("found %d expired reservations with readerID %s", len(coreReservations), readerID)
 
 	reservations := make([]*models.ReservationModel, len(coreReservations))
 	for i, coreReservation := range coreReservations {
@@ -236,36 +282,35 @@ func (rr *ReservationRepo) GetExpiredByReaderID(ctx context.Context, readerID uu
 	return reservations, nil
 }
 
-func (rr *ReservationRepo) GetActiveByReaderID(ctx context.Context, readerID uuid.UUID) ([]*models.ReservationModel, error) {
-	rr.logger.Infof("find active reservations with readerID: %s", readerID)
+func (rr *ReservationRepo) GetActiveByReaderID(ctx context.Context, readerID uuid.UUID) (_ []*models.ReservationModel, err error) {
+	ctx, span := startSpan(ctx, "reservation", "GetActiveByReaderID")
+	defer func() { span.end(err) }()
+
+	rr.logger.Debugf("find active reservations with readerID: %s", readerID)
+
+	ctx = transact.SessionContext(ctx)
 
-	if err := rr.updateReservationStates(ctx); err != nil {
-		rr.logger.Errorf("error updating reservations status: %v", err)
-		return nil, err
-	}
 	filter := bson.M{
 		"reader_id": readerID,
 		"state": bson.M{
 			"$nin": []string{impl.ReservationExpired, impl.ReservationClosed},
 		},
+		"return_date": bson.M{"$gte": time.Now()},
 	}
 
 	cursor, err := rr.db.Find(ctx, filter)
 	if err != nil {
-		rr.logger.Errorf("error find active reservations: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error find active reservations", err)
 	}
 	defer func(cursor *mongo.Cursor, ctx context.Context) {
-		err = cursor.Close(ctx)
-		if err != nil {
-			fmt.Println("error close cursor")
+		if err := cursor.Close(ctx); err != nil {
+			rr.logger.Warnf("error closing cursor: %v", err)
 		}
 	}(cursor, ctx)
 
 	var coreReservations []*repomodels.ReservationModel
 	if err = cursor.All(ctx, &coreReservations); err != nil {
-		rr.logger.Printf("error decoding reservations: %v", err)
-		return nil, err
+		return nil, logRepoError(rr.logger, "error decoding reservations", err)
 	}
 
 	if len(coreReservations) == 0 {
@@ -273,7 +318,7 @@ func (rr *ReservationRepo) GetActiveByReaderID(ctx context.Context, readerID uui
 		return nil, errs.ErrReservationDoesNotExists
 	}
 
-	rr.logger.Infof("found %d active reservations with readerID %s", len(coreReservations), readerID)
+	rr.logger.Debugf("found %d active reservations with readerID %s", len(coreReservations), readerID)
 
 	reservations := make([]*models.ReservationModel, len(coreReservations))
 	for i, coreReservation := range coreReservations {
@@ -283,21 +328,33 @@ func (rr *ReservationRepo) GetActiveByReaderID(ctx context.Context, readerID uui
 	return reservations, nil
 }
 
-func (rr *ReservationRepo) updateReservationStates(ctx context.Context) error {
-	filterExpired := bson.M{
-		"state":      bson.M{"$in": []string{impl.ReservationIssued, impl.ReservationExtended}},
-		"returnDate": bson.M{"$lt": time.Now()},
-	}
-	updateExpired := bson.M{
-		"$set": bson.M{"state": impl.ReservationExpired},
+func (rr *ReservationRepo) checkVersionConflictReason(ctx context.Context, ID uuid.UUID) error {
+	count, err := rr.db.CountDocuments(ctx, bson.M{"_id": ID})
+	if err != nil {
+		return logRepoError(rr.logger, "error find reservation", err)
 	}
 
-	_, err := rr.db.UpdateMany(ctx, filterExpired, updateExpired)
-	if err != nil {
-		return err
+	if count == 0 {
+		rr.logger.Warnf("reservation with this ID not found: %v", ID)
+		return errs.ErrReservationDoesNotExists
 	}
 
-	return nil
+	rr.logger.Warnf("reservation with ID %s was modified by another writer", ID)
+
+	return repoerrs.ErrReservationVersionConflict
+}
+
+func (rr *ReservationRepo) getUpdateData(reservation *models.ReservationModel) bson.M {
+	return bson.M{
+		"$set": bson.M{
+			"reader_id":   reservation.ReaderID,
+			"book_id":     reservation.BookID,
+			"issue_date":  reservation.IssueDate,
+			"return_date": reservation.ReturnDate,
+			"state":       reservation.State,
+		},
+		"$inc": bson.M{"version": 1},
+	}
 }
 
 func (rr *ReservationRepo) convertToRepoReservationModel(reservation *models.ReservationModel) *repomodels.ReservationModel {
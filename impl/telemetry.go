@@ -0,0 +1,118 @@
+package impl
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"sync/atomic"
+	"time"
+)
+
+const instrumentationName = "github.com/nikitalystsev/BookSmart-repo-mongo/impl"
+
+// repoTelemetry -- трассировка и метрики операций репозиториев
+type repoTelemetry struct {
+	tracer   trace.Tracer
+	calls    metric.Int64Counter
+	duration metric.Float64Histogram
+}
+
+// telemetry по умолчанию использует глобальные провайдеры otel, поэтому подхватывает провайдеры,
+// установленные приложением через otel.SetTracerProvider и otel.SetMeterProvider.
+// Заменяется через SetTelemetryProviders во время работы репозиториев
+var telemetry atomic.Pointer[repoTelemetry]
+
+func init() {
+	telemetry.Store(mustRepoTelemetry(otel.GetTracerProvider(), otel.GetMeterProvider()))
+}
+
+// SetTelemetryProviders переключает трассировку и метрики репозиториев на заданные провайдеры,
+// например на провайдеры с in-memory экспортерами
+func SetTelemetryProviders(tp trace.TracerProvider, mp metric.MeterProvider) error {
+	t, err := newRepoTelemetry(tp, mp)
+	if err != nil {
+		return err
+	}
+	telemetry.Store(t)
+
+	return nil
+}
+
+func newRepoTelemetry(tp trace.TracerProvider, mp metric.MeterProvider) (*repoTelemetry, error) {
+	meter := mp.Meter(instrumentationName)
+
+	calls, err := meter.Int64Counter("repo.operation.calls",
+		metric.WithDescription("Number of repository operations"),
+		metric.WithUnit("{call}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := meter.Float64Histogram("repo.operation.duration",
+		metric.WithDescription("Duration of repository operations"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &repoTelemetry{tracer: tp.Tracer(instrumentationName), calls: calls, duration: duration}, nil
+}
+
+func mustRepoTelemetry(tp trace.TracerProvider, mp metric.MeterProvider) *repoTelemetry {
+	t, err := newRepoTelemetry(tp, mp)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+// repoSpan -- незавершенная операция репозитория
+type repoSpan struct {
+	telemetry  *repoTelemetry
+	ctx        context.Context
+	span       trace.Span
+	start      time.Time
+	attributes []attribute.KeyValue
+}
+
+// startSpan открывает span операции operation над коллекцией collection. Вызывающий обязан вызвать end
+func startSpan(ctx context.Context, collection, operation string) (context.Context, *repoSpan) {
+	attributes := []attribute.KeyValue{
+		attribute.String("db.collection.name", collection),
+		attribute.String("db.operation.name", operation),
+	}
+
+	t := telemetry.Load()
+	ctx, span := t.tracer.Start(ctx, collection+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attributes...),
+	)
+
+	return ctx, &repoSpan{telemetry: t, ctx: ctx, span: span, start: time.Now(), attributes: attributes}
+}
+
+// end завершает span и записывает метрики с исходом операции
+func (rs *repoSpan) end(err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = errorClass(err)
+		// отсутствие документа -- штатный исход, а не сбой операции
+		if outcome != "not_found" {
+			rs.span.RecordError(err)
+			rs.span.SetStatus(codes.Error, err.Error())
+		}
+	}
+
+	rs.span.SetAttributes(attribute.String("outcome", outcome))
+	rs.span.End()
+
+	opts := metric.WithAttributes(append(rs.attributes, attribute.String("outcome", outcome))...)
+	rs.telemetry.calls.Add(rs.ctx, 1, opts)
+	rs.telemetry.duration.Record(rs.ctx, time.Since(rs.start).Seconds(), opts)
+}
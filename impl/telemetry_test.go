@@ -0,0 +1,141 @@
+package impl
+
+import (
+	"context"
+	"github.com/nikitalystsev/BookSmart-services/errs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+func setupTelemetry(t *testing.T) (*tracetest.InMemoryExporter, *sdkmetric.ManualReader) {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	reader := sdkmetric.NewManualReader()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	if err := SetTelemetryProviders(tp, mp); err != nil {
+		t.Fatalf("error setting telemetry providers: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := SetTelemetryProviders(otel.GetTracerProvider(), otel.GetMeterProvider()); err != nil {
+			t.Errorf("error restoring telemetry providers: %v", err)
+		}
+	})
+
+	return exporter, reader
+}
+
+func TestRepoSpanRecordsAttributes(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		outcome string
+		status  codes.Code
+	}{
+		{name: "ok", err: nil, outcome: "ok", status: codes.Unset},
+		{name: "not found", err: errs.ErrBookDoesNotExists, outcome: "not_found", status: codes.Unset},
+		{name: "timeout", err: translateError(context.DeadlineExceeded), outcome: "timeout", status: codes.Error},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter, _ := setupTelemetry(t)
+
+			_, span := startSpan(context.Background(), "book", "GetByID")
+			span.end(tt.err)
+
+			spans := exporter.GetSpans()
+			if len(spans) != 1 {
+				t.Fatalf("expected 1 span, got %d", len(spans))
+			}
+
+			got := spans[0]
+			if got.Name != "book.GetByID" {
+				t.Errorf("expected span name book.GetByID, got %s", got.Name)
+			}
+			if got.Status.Code != tt.status {
+				t.Errorf("expected status %v, got %v", tt.status, got.Status.Code)
+			}
+
+			attributes := attribute.NewSet(got.Attributes...)
+			for key, want := range map[attribute.Key]string{
+				"db.collection.name": "book",
+				"db.operation.name":  "GetByID",
+				"outcome":            tt.outcome,
+			} {
+				if value, ok := attributes.Value(key); !ok || value.AsString() != want {
+					t.Errorf("expected %s = %q, got %q", key, want, value.AsString())
+				}
+			}
+		})
+	}
+}
+
+func TestRepoSpanRecordsMetrics(t *testing.T) {
+	_, reader := setupTelemetry(t)
+
+	for _, err := range []error{nil, nil, errs.ErrBookDoesNotExists} {
+		_, span := startSpan(context.Background(), "book", "GetByID")
+		span.end(err)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("error collecting metrics: %v", err)
+	}
+
+	calls := map[string]int64{}
+	durations := map[string]uint64{}
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				if m.Name != "repo.operation.calls" {
+					continue
+				}
+				for _, point := range data.DataPoints {
+					calls[getOutcome(t, point.Attributes)] += point.Value
+				}
+			case metricdata.Histogram[float64]:
+				if m.Name != "repo.operation.duration" {
+					continue
+				}
+				for _, point := range data.DataPoints {
+					durations[getOutcome(t, point.Attributes)] += point.Count
+				}
+			}
+		}
+	}
+
+	for outcome, want := range map[string]int64{"ok": 2, "not_found": 1} {
+		if calls[outcome] != want {
+			t.Errorf("expected %d calls with outcome %s, got %d", want, outcome, calls[outcome])
+		}
+		if durations[outcome] != uint64(want) {
+			t.Errorf("expected %d durations with outcome %s, got %d", want, outcome, durations[outcome])
+		}
+	}
+}
+
+func getOutcome(t *testing.T, attributes attribute.Set) string {
+	t.Helper()
+
+	if value, ok := attributes.Value("db.collection.name"); !ok || value.AsString() != "book" {
+		t.Errorf("expected db.collection.name = book, got %q", value.AsString())
+	}
+	if value, ok := attributes.Value("db.operation.name"); !ok || value.AsString() != "GetByID" {
+		t.Errorf("expected db.operation.name = GetByID, got %q", value.AsString())
+	}
+
+	value, _ := attributes.Value("outcome")
+
+	return value.AsString()
+}
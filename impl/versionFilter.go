@@ -0,0 +1,15 @@
+package impl
+
+import (
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// getVersionFilter -- документ с заданными _id и версией. Документы, созданные до появления версий, имеют версию 0
+func getVersionFilter(ID uuid.UUID, version int64) bson.M {
+	if version == 0 {
+		return bson.M{"_id": ID, "$or": bson.A{bson.M{"version": 0}, bson.M{"version": bson.M{"$exists": false}}}}
+	}
+
+	return bson.M{"_id": ID, "version": version}
+}
@@ -0,0 +1,131 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RenameField переименовывает поле во всех документах коллекции, где оно присутствует
+func RenameField(ctx context.Context, coll *mongo.Collection, from, to string) error {
+	_, err := coll.UpdateMany(ctx,
+		bson.M{from: bson.M{"$exists": true}},
+		bson.M{"$rename": bson.M{from: to}},
+	)
+
+	return err
+}
+
+// BackfillField выставляет значение по умолчанию в документах, где поле отсутствует
+func BackfillField(ctx context.Context, coll *mongo.Collection, field string, value interface{}) error {
+	_, err := coll.UpdateMany(ctx,
+		bson.M{field: bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{field: value}},
+	)
+
+	return err
+}
+
+// UnsetField удаляет поле из всех документов коллекции
+func UnsetField(ctx context.Context, coll *mongo.Collection, field string) error {
+	_, err := coll.UpdateMany(ctx,
+		bson.M{field: bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{field: ""}},
+	)
+
+	return err
+}
+
+// ConvertField приводит значение поля к BSON-типу bsonType ("int", "long", "double", "string", "date", "bool", ...)
+func ConvertField(ctx context.Context, coll *mongo.Collection, field, bsonType string) error {
+	_, err := coll.UpdateMany(ctx,
+		bson.M{field: bson.M{"$exists": true, "$not": bson.M{"$type": bsonType}}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{field: bson.M{"$convert": bson.M{"input": "$" + field, "to": bsonType}}}}},
+		},
+	)
+
+	return err
+}
+
+// DropIndex удаляет индекс коллекции по имени. Отсутствие индекса не считается ошибкой
+func DropIndex(ctx context.Context, coll *mongo.Collection, name string) error {
+	_, err := coll.Indexes().DropOne(ctx, name)
+
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Name == "IndexNotFound" || cmdErr.Name == "NamespaceNotFound") {
+		return nil
+	}
+
+	return err
+}
+
+// RemoveDuplicates удаляет документы с повторяющимися значениями полей fields. Из каждой группы остается
+// первый документ в порядке sort
+func RemoveDuplicates(ctx context.Context, coll *mongo.Collection, fields []string, sort bson.D) error {
+	key := bson.M{}
+	for _, field := range fields {
+		key[field] = "$" + field
+	}
+
+	cursor, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$sort", Value: sort}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   key,
+			"ids":   bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	var groups []struct {
+		IDs []interface{} `bson:"ids"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return err
+	}
+
+	var duplicates bson.A
+	for _, group := range groups {
+		duplicates = append(duplicates, group.IDs[1:]...)
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	_, err = coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": duplicates}})
+
+	return err
+}
+
+// EnsureUniqueIndex создает уникальный индекс name. Неуникальный индекс с тем же именем сначала удаляется
+func EnsureUniqueIndex(ctx context.Context, coll *mongo.Collection, name string, keys bson.D) error {
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, spec := range specs {
+		if spec.Name != name {
+			continue
+		}
+		if spec.Unique != nil && *spec.Unique {
+			return nil
+		}
+		if err = DropIndex(ctx, coll, name); err != nil {
+			return err
+		}
+	}
+
+	_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    keys,
+		Options: options.Index().SetName(name).SetUnique(true),
+	})
+
+	return err
+}
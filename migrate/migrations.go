@@ -0,0 +1,157 @@
+package migrate
+
+import (
+	"context"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/impl"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+// Migrations -- все миграции схемы. Новые миграции добавляются в конец с версией вида YYYYMMDDhhmmss
+var Migrations = []Migration{
+	{
+		Version:     20241018090000,
+		Description: "reservation: rename returnDate to return_date",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			return RenameField(ctx, db.Collection("reservation"), "returnDate", "return_date")
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return ErrIrreversibleMigration // обратное переименование вернуло бы несоответствие с ReservationModel
+		},
+	},
+	{
+		Version:     20241018100000,
+		Description: "book, reservation, lib_card: backfill version for optimistic locking",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			for _, name := range []string{"book", "reservation", "lib_card"} {
+				if err := BackfillField(ctx, db.Collection(name), "version", int64(0)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			for _, name := range []string{"book", "reservation", "lib_card"} {
+				if err := UnsetField(ctx, db.Collection(name), "version"); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version:     20241018110000,
+		Description: "book: backfill created_at for newest-first sorting",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			return BackfillField(ctx, db.Collection("book"), "created_at", time.Unix(0, 0).UTC())
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return UnsetField(ctx, db.Collection("book"), "created_at")
+		},
+	},
+	{
+		Version:       20241018120000,
+		Description:   "book: compute rating_sum, rating_count and rating_avg from rating",
+		NoTransaction: true,
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// до 20241018150000 у оценок нет status, поэтому учитываются все
+			cursor, err := db.Collection("book").Aggregate(ctx, impl.BookRatingSummaryPipeline("rating", "book", nil))
+			if err != nil {
+				return err
+			}
+
+			return cursor.Close(ctx)
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			for _, field := range []string{"rating_sum", "rating_count", "rating_avg"} {
+				if err := UnsetField(ctx, db.Collection("book"), field); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version:       20241018130000,
+		Description:   "rating: remove duplicate (reader_id, book_id) ratings and replace reader_id_1_book_id_1 with a unique index",
+		NoTransaction: true,
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			coll := db.Collection("rating")
+
+			// остается самая поздняя оценка читателя; у оценок без created_at -- любая из них
+			sort := bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: 1}}
+			if err := RemoveDuplicates(ctx, coll, []string{"reader_id", "book_id"}, sort); err != nil {
+				return err
+			}
+
+			// сводки из 20241018120000 учитывали удаленные дубликаты
+			cursor, err := db.Collection("book").Aggregate(ctx, impl.BookRatingSummaryPipeline("rating", "book", nil))
+			if err != nil {
+				return err
+			}
+			if err = cursor.Close(ctx); err != nil {
+				return err
+			}
+
+			if err = DropIndex(ctx, coll, "reader_id_1_book_id_1"); err != nil {
+				return err
+			}
+
+			return EnsureUniqueIndex(ctx, coll, "reader_id_1_book_id_1_unique", bson.D{{Key: "reader_id", Value: 1}, {Key: "book_id", Value: 1}})
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return ErrIrreversibleMigration // удаленные дубликаты не восстанавливаются
+		},
+	},
+	{
+		Version:     20241018140000,
+		Description: "rating: backfill created_at for the review feed",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			return BackfillField(ctx, db.Collection("rating"), "created_at", time.Unix(0, 0).UTC())
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return UnsetField(ctx, db.Collection("rating"), "created_at")
+		},
+	},
+	{
+		Version:     20241018150000,
+		Description: "rating: backfill status, existing reviews are treated as approved",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			return BackfillField(ctx, db.Collection("rating"), "status", "Approved")
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return UnsetField(ctx, db.Collection("rating"), "status")
+		},
+	},
+	{
+		Version:       20241018160000,
+		Description:   "favorite_books: remove duplicate rows and create the unique reader_id_1_book_id_1 index",
+		NoTransaction: true,
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			coll := db.Collection("favorite_books")
+
+			if err := RemoveDuplicates(ctx, coll, []string{"reader_id", "book_id"}, bson.D{{Key: "_id", Value: 1}}); err != nil {
+				return err
+			}
+
+			return EnsureUniqueIndex(ctx, coll, "reader_id_1_book_id_1", bson.D{{Key: "reader_id", Value: 1}, {Key: "book_id", Value: 1}})
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return ErrIrreversibleMigration // удаленные дубликаты не восстанавливаются
+		},
+	},
+	{
+		Version:     20241018170000,
+		Description: "favorite_books: backfill added_at for the favorites list",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			return BackfillField(ctx, db.Collection("favorite_books"), "added_at", time.Unix(0, 0).UTC())
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return UnsetField(ctx, db.Collection("favorite_books"), "added_at")
+		},
+	},
+}
@@ -0,0 +1,235 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/pkg/transact"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sort"
+	"time"
+)
+
+const migrationsCollection = "schema_migrations"
+
+var (
+	ErrNoAppliedMigrations = errors.New("no applied migrations")
+	// ErrIrreversibleMigration возвращается из Down миграций, которые нельзя откатить. Запись о применении остается
+	ErrIrreversibleMigration = errors.New("migration is irreversible")
+)
+
+// Migration -- версионированное изменение схемы. Up применяет изменение, Down откатывает его.
+// Если NoTransaction выставлен, миграция выполняется вне транзакции (например, для создания коллекций и индексов)
+type Migration struct {
+	Version       int64
+	Description   string
+	Up            func(ctx context.Context, db *mongo.Database) error
+	Down          func(ctx context.Context, db *mongo.Database) error
+	NoTransaction bool
+}
+
+type MigrationStatus struct {
+	Version     int64
+	Description string
+	Applied     bool
+	AppliedAt   time.Time
+}
+
+type appliedMigration struct {
+	Version     int64     `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+type Migrator struct {
+	db         *mongo.Database
+	applied    *mongo.Collection
+	migrations []Migration
+	logger     *logrus.Entry
+}
+
+func NewMigrator(db *mongo.Database, migrations []Migration, logger *logrus.Entry) (*Migrator, error) {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	for i, m := range sorted {
+		if m.Up == nil || m.Down == nil {
+			return nil, fmt.Errorf("migration %d: Up and Down must be set", m.Version)
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, fmt.Errorf("migration %d: duplicate version", m.Version)
+		}
+	}
+
+	return &Migrator{
+		db:         db,
+		applied:    db.Collection(migrationsCollection),
+		migrations: sorted,
+		logger:     logger,
+	}, nil
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.getApplied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		statuses[i] = MigrationStatus{Version: migration.Version, Description: migration.Description}
+		if record, ok := applied[migration.Version]; ok {
+			statuses[i].Applied = true
+			statuses[i].AppliedAt = record.AppliedAt
+		}
+	}
+
+	return statuses, nil
+}
+
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	applied, err := m.getApplied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// Up применяет все неприменённые миграции по возрастанию версии и возвращает их количество
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, migration := range pending {
+		m.logger.Infof("applying migration %d: %s", migration.Version, migration.Description)
+
+		err = m.run(ctx, migration, func(ctx context.Context) error {
+			if err := migration.Up(ctx, m.db); err != nil {
+				return err
+			}
+
+			record := appliedMigration{
+				Version:     migration.Version,
+				Description: migration.Description,
+				AppliedAt:   time.Now(),
+			}
+			_, err := m.applied.InsertOne(ctx, record)
+
+			return err
+		})
+		if err != nil {
+			m.logger.Errorf("error applying migration %d: %v", migration.Version, err)
+			return i, fmt.Errorf("migration %d: %w", migration.Version, err)
+		}
+
+		m.logger.Infof("applied migration %d", migration.Version)
+	}
+
+	return len(pending), nil
+}
+
+// Down откатывает последнюю применённую миграцию
+func (m *Migrator) Down(ctx context.Context) (*Migration, error) {
+	applied, err := m.getApplied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var last *Migration
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		if _, ok := applied[m.migrations[i].Version]; ok {
+			last = &m.migrations[i]
+			break
+		}
+	}
+	if last == nil {
+		return nil, ErrNoAppliedMigrations
+	}
+
+	m.logger.Infof("reverting migration %d: %s", last.Version, last.Description)
+
+	err = m.run(ctx, *last, func(ctx context.Context) error {
+		if err := last.Down(ctx, m.db); err != nil {
+			return err
+		}
+
+		_, err := m.applied.DeleteOne(ctx, bson.M{"_id": last.Version})
+
+		return err
+	})
+	if err != nil {
+		m.logger.Errorf("error reverting migration %d: %v", last.Version, err)
+		return nil, fmt.Errorf("migration %d: %w", last.Version, err)
+	}
+
+	m.logger.Infof("reverted migration %d", last.Version)
+
+	return last, nil
+}
+
+func (m *Migrator) getApplied(ctx context.Context) (map[int64]appliedMigration, error) {
+	cursor, err := m.applied.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer func(cursor *mongo.Cursor, ctx context.Context) {
+		err = cursor.Close(ctx)
+		if err != nil {
+			m.logger.Warnf("error closing cursor: %v", err)
+		}
+	}(cursor, ctx)
+
+	var records []appliedMigration
+	if err = cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]appliedMigration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+
+	return applied, nil
+}
+
+// run выполняет fn в транзакции, если сервер их поддерживает (replica set или mongos)
+func (m *Migrator) run(ctx context.Context, migration Migration, fn func(ctx context.Context) error) error {
+	if migration.NoTransaction {
+		return fn(ctx)
+	}
+
+	supported, err := transact.TransactionsSupported(ctx, m.db.Client())
+	if err != nil {
+		return err
+	}
+	if !supported {
+		m.logger.Warnf("transactions are not supported, migration %d runs without session", migration.Version)
+		return fn(ctx)
+	}
+
+	session, err := m.db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+
+	return err
+}
@@ -0,0 +1,80 @@
+package repoMongo
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"sync"
+	"sync/atomic"
+)
+
+const instrumentationName = "github.com/nikitalystsev/BookSmart-repo-mongo"
+
+// commandMonitor записывает длительность каждой команды MongoDB в гистограмму mongo.command.duration
+// и считает команды, ожидающие ответа сервера
+type commandMonitor struct {
+	duration    metric.Float64Histogram
+	collections sync.Map // RequestID -> имя коллекции команды
+	inflight    atomic.Int64
+}
+
+// NewCommandMonitor создает монитор команд, пишущий метрики в mp. NewClient регистрирует его
+// с глобальным провайдером otel
+func NewCommandMonitor(mp metric.MeterProvider) (*event.CommandMonitor, error) {
+	cm, err := newCommandMonitor(mp)
+	if err != nil {
+		return nil, err
+	}
+
+	return cm.eventMonitor(), nil
+}
+
+func newCommandMonitor(mp metric.MeterProvider) (*commandMonitor, error) {
+	duration, err := mp.Meter(instrumentationName).Float64Histogram("mongo.command.duration",
+		metric.WithDescription("Duration of MongoDB commands as seen by the driver"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &commandMonitor{duration: duration}, nil
+}
+
+func (cm *commandMonitor) eventMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{Started: cm.started, Succeeded: cm.succeeded, Failed: cm.failed}
+}
+
+func (cm *commandMonitor) started(_ context.Context, evt *event.CommandStartedEvent) {
+	cm.inflight.Add(1)
+
+	// первый элемент команды -- ее имя со значением-коллекцией: {find: "book", ...}
+	if collection, ok := evt.Command.Lookup(evt.CommandName).StringValueOK(); ok {
+		cm.collections.Store(evt.RequestID, collection)
+	}
+}
+
+func (cm *commandMonitor) succeeded(ctx context.Context, evt *event.CommandSucceededEvent) {
+	cm.record(ctx, &evt.CommandFinishedEvent, "ok")
+}
+
+func (cm *commandMonitor) failed(ctx context.Context, evt *event.CommandFailedEvent) {
+	cm.record(ctx, &evt.CommandFinishedEvent, "error")
+}
+
+func (cm *commandMonitor) record(ctx context.Context, evt *event.CommandFinishedEvent, outcome string) {
+	cm.inflight.Add(-1)
+
+	collection := ""
+	if value, ok := cm.collections.LoadAndDelete(evt.RequestID); ok {
+		collection = value.(string)
+	}
+
+	cm.duration.Record(ctx, evt.Duration.Seconds(), metric.WithAttributes(
+		attribute.String("db.namespace", evt.DatabaseName),
+		attribute.String("db.collection.name", collection),
+		attribute.String("db.operation.name", evt.CommandName),
+		attribute.String("outcome", outcome),
+	))
+}
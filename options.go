@@ -0,0 +1,96 @@
+package repoMongo
+
+import (
+	"crypto/tls"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"time"
+)
+
+// DefaultConnectTimeout -- ограничение на подключение и первый ping в NewClient
+const DefaultConnectTimeout = 10 * time.Second
+
+type clientConfig struct {
+	connectTimeout time.Duration
+	clientOptions  *options.ClientOptions
+	monitor        *commandMonitor
+}
+
+// ClientOption -- настройка клиента, создаваемого NewClient
+type ClientOption func(*clientConfig)
+
+// WithConnectTimeout задает общий срок на подключение и ping. Нулевое значение снимает ограничение
+func WithConnectTimeout(timeout time.Duration) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.connectTimeout = timeout
+	}
+}
+
+// WithMaxPoolSize задает максимальное количество соединений в пуле на каждый сервер
+func WithMaxPoolSize(size uint64) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.clientOptions.SetMaxPoolSize(size)
+	}
+}
+
+// WithMinPoolSize задает минимальное количество соединений, поддерживаемых в пуле на каждый сервер
+func WithMinPoolSize(size uint64) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.clientOptions.SetMinPoolSize(size)
+	}
+}
+
+// WithServerSelectionTimeout задает, сколько операция ждет подходящий сервер
+func WithServerSelectionTimeout(timeout time.Duration) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.clientOptions.SetServerSelectionTimeout(timeout)
+	}
+}
+
+func WithReadPreference(rp *readpref.ReadPref) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.clientOptions.SetReadPreference(rp)
+	}
+}
+
+func WithWriteConcern(wc *writeconcern.WriteConcern) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.clientOptions.SetWriteConcern(wc)
+	}
+}
+
+func WithReadConcern(rc *readconcern.ReadConcern) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.clientOptions.SetReadConcern(rc)
+	}
+}
+
+// WithTLSConfig включает TLS с заданной конфигурацией
+func WithTLSConfig(tlsConfig *tls.Config) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.clientOptions.SetTLSConfig(tlsConfig)
+	}
+}
+
+// WithAppName задает имя приложения, которое сервер пишет в логи и профайлер
+func WithAppName(name string) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.clientOptions.SetAppName(name)
+	}
+}
+
+// WithCompressors задает алгоритмы сжатия трафика в порядке предпочтения ("zstd", "zlib", "snappy")
+func WithCompressors(compressors ...string) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.clientOptions.SetCompressors(compressors)
+	}
+}
+
+// withCommandMonitor подменяет монитор команд, чтобы Store мог отслеживать незавершенные команды
+func withCommandMonitor(cm *commandMonitor) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.monitor = cm
+	}
+}
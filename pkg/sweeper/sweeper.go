@@ -0,0 +1,63 @@
+package sweeper
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+const DefaultInterval = time.Minute
+
+// SweepFunc выполняет один проход фоновой задачи и возвращает количество измененных документов
+type SweepFunc func(ctx context.Context, now time.Time) (int64, error)
+
+// Sweeper периодически вызывает SweepFunc, пока не будет отменен контекст
+type Sweeper struct {
+	name     string
+	interval time.Duration
+	sweep    SweepFunc
+	logger   *logrus.Entry
+}
+
+func NewSweeper(name string, interval time.Duration, sweep SweepFunc, logger *logrus.Entry) *Sweeper {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	return &Sweeper{name: name, interval: interval, sweep: sweep, logger: logger}
+}
+
+// Run выполняет проход сразу, затем каждые interval. Блокируется до отмены ctx
+func (s *Sweeper) Run(ctx context.Context) {
+	s.logger.Infof("%s sweeper started with interval %s", s.name, s.interval)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.runOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			s.logger.Infof("%s sweeper stopped", s.name)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Sweeper) runOnce(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	changed, err := s.sweep(ctx, time.Now())
+	if err != nil {
+		s.logger.Errorf("%s sweep error: %v", s.name, err)
+		return
+	}
+
+	if changed > 0 {
+		s.logger.Infof("%s sweep changed %d documents", s.name, changed)
+	}
+}
@@ -0,0 +1,141 @@
+package transact
+
+import (
+	"context"
+	"github.com/avito-tech/go-transaction-manager/trm/v2"
+	trmcontext "github.com/avito-tech/go-transaction-manager/trm/v2/context"
+	"github.com/avito-tech/go-transaction-manager/trm/v2/drivers"
+	"github.com/avito-tech/go-transaction-manager/trm/v2/manager"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
+)
+
+// Transaction -- реализация trm.Transaction поверх mongo.Session
+type Transaction struct {
+	session  mongo.Session
+	isClosed *drivers.IsClosed
+}
+
+// NewManager создает менеджер транзакций, который можно передать в transact.NewTransactionManager сервисов
+func NewManager(client *mongo.Client, opts ...*options.TransactionOptions) (*manager.Manager, error) {
+	return manager.New(NewTrFactory(client, opts...))
+}
+
+// NewTrFactory возвращает фабрику, открывающую новую сессию и транзакцию на каждый вызов
+func NewTrFactory(client *mongo.Client, opts ...*options.TransactionOptions) trm.TrFactory {
+	return func(ctx context.Context, _ trm.Settings) (context.Context, trm.Transaction, error) {
+		session, err := client.StartSession()
+		if err != nil {
+			return ctx, nil, err
+		}
+
+		if err = session.StartTransaction(opts...); err != nil {
+			session.EndSession(ctx)
+			return ctx, nil, err
+		}
+
+		return ctx, &Transaction{session: session, isClosed: drivers.NewIsClosed()}, nil
+	}
+}
+
+// SessionContext возвращает контекст с сессией активной транзакции, если она открыта менеджером, иначе ctx без изменений.
+// Операции драйвера, выполненные с этим контекстом, попадают в транзакцию
+func SessionContext(ctx context.Context) context.Context {
+	tr := trmcontext.DefaultManager.Default(ctx)
+	if tr == nil || !tr.IsActive() {
+		return ctx
+	}
+
+	session, ok := tr.Transaction().(mongo.Session)
+	if !ok {
+		return ctx
+	}
+
+	return mongo.NewSessionContext(ctx, session)
+}
+
+// WithTransaction выполняет fn в транзакции. Если ctx уже содержит сессию или активную транзакцию менеджера,
+// fn выполняется в ней, иначе открывается новая транзакция. На standalone-сервере, не поддерживающем
+// транзакции, fn выполняется без нее
+func WithTransaction(ctx context.Context, client *mongo.Client, fn func(ctx context.Context) error) error {
+	ctx = SessionContext(ctx)
+	if mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+
+	supported, err := TransactionsSupported(ctx, client)
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return fn(ctx)
+	}
+
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+
+	return err
+}
+
+// transactionsSupport -- результат TransactionsSupported для каждого клиента: *mongo.Client -> bool
+var transactionsSupport sync.Map
+
+// TransactionsSupported сообщает, поддерживает ли сервер транзакции: они доступны только в наборе реплик и через mongos.
+// Сервер опрашивается один раз на клиента, ошибки не кешируются
+func TransactionsSupported(ctx context.Context, client *mongo.Client) (bool, error) {
+	if supported, ok := transactionsSupport.Load(client); ok {
+		return supported.(bool), nil
+	}
+
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return false, err
+	}
+
+	supported := hello.SetName != "" || hello.Msg == "isdbgrid"
+	transactionsSupport.Store(client, supported)
+
+	return supported, nil
+}
+
+func (t *Transaction) Transaction() interface{} {
+	return t.session
+}
+
+func (t *Transaction) Commit(ctx context.Context) error {
+	err := t.session.CommitTransaction(ctx)
+	t.session.EndSession(ctx)
+	t.isClosed.CloseWithCause(err)
+
+	return err
+}
+
+func (t *Transaction) Rollback(ctx context.Context) error {
+	err := t.session.AbortTransaction(ctx)
+	t.session.EndSession(ctx)
+	t.isClosed.CloseWithCause(err)
+
+	return err
+}
+
+func (t *Transaction) IsActive() bool {
+	return t.isClosed.IsActive()
+}
+
+func (t *Transaction) Closed() <-chan struct{} {
+	return t.isClosed.Closed()
+}
@@ -0,0 +1,321 @@
+package repoMongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type schemaIndex struct {
+	name    string
+	keys    bson.D
+	unique  bool
+	weights bson.D
+	// replaces -- индекс с теми же ключами, который заменяется миграцией. Пока он есть, индекс не создается
+	replaces string
+}
+
+type schemaCollection struct {
+	name    string
+	indexes []schemaIndex
+}
+
+// expectedSchema -- коллекции и индексы, которые должны существовать в БД
+var expectedSchema = []schemaCollection{
+	{
+		name: "book",
+		indexes: []schemaIndex{
+			{name: "title_1__id_1", keys: bson.D{{Key: "title", Value: 1}, {Key: "_id", Value: 1}}},
+			{name: "author_1__id_1", keys: bson.D{{Key: "author", Value: 1}, {Key: "_id", Value: 1}}},
+			{name: "publishing_year_1__id_1", keys: bson.D{{Key: "publishing_year", Value: 1}, {Key: "_id", Value: 1}}},
+			{name: "copies_number_1__id_1", keys: bson.D{{Key: "copies_number", Value: 1}, {Key: "_id", Value: 1}}},
+			{name: "created_at_1__id_1", keys: bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}},
+			{name: "rating_avg_1__id_1", keys: bson.D{{Key: "rating_avg", Value: 1}, {Key: "_id", Value: 1}}},
+			{name: "genre_1_publishing_year_1", keys: bson.D{{Key: "genre", Value: 1}, {Key: "publishing_year", Value: 1}}},
+			{name: "language_1", keys: bson.D{{Key: "language", Value: 1}}},
+			{name: "rarity_1", keys: bson.D{{Key: "rarity", Value: 1}}},
+			{
+				name: "book_text",
+				keys: bson.D{
+					{Key: "title", Value: "text"}, {Key: "author", Value: "text"},
+					{Key: "publisher", Value: "text"}, {Key: "genre", Value: "text"},
+				},
+				weights: bson.D{{Key: "title", Value: 10}, {Key: "author", Value: 5}, {Key: "genre", Value: 2}, {Key: "publisher", Value: 1}},
+			},
+		},
+	},
+	{
+		name: "reader",
+		indexes: []schemaIndex{
+			{name: "phone_number_1", keys: bson.D{{Key: "phone_number", Value: 1}}, unique: true},
+		},
+	},
+	{
+		name: "favorite_books",
+		indexes: []schemaIndex{
+			{name: "reader_id_1_book_id_1", keys: bson.D{{Key: "reader_id", Value: 1}, {Key: "book_id", Value: 1}}, unique: true},
+			{name: "book_id_1", keys: bson.D{{Key: "book_id", Value: 1}}},
+		},
+	},
+	{
+		name: "lib_card",
+		indexes: []schemaIndex{
+			{name: "lib_card_num_1", keys: bson.D{{Key: "lib_card_num", Value: 1}}, unique: true},
+			{name: "reader_id_1", keys: bson.D{{Key: "reader_id", Value: 1}}},
+			{name: "action_status_1_issue_date_1", keys: bson.D{{Key: "action_status", Value: 1}, {Key: "issue_date", Value: 1}}},
+		},
+	},
+	{
+		name: "reservation",
+		indexes: []schemaIndex{
+			{name: "reader_id_1_book_id_1", keys: bson.D{{Key: "reader_id", Value: 1}, {Key: "book_id", Value: 1}}},
+			{name: "reader_id_1_state_1", keys: bson.D{{Key: "reader_id", Value: 1}, {Key: "state", Value: 1}}},
+			{name: "book_id_1", keys: bson.D{{Key: "book_id", Value: 1}}},
+			{name: "state_1_return_date_1", keys: bson.D{{Key: "state", Value: 1}, {Key: "return_date", Value: 1}}},
+		},
+	},
+	{
+		name: "rating",
+		indexes: []schemaIndex{
+			{name: "book_id_1", keys: bson.D{{Key: "book_id", Value: 1}}},
+			{name: "book_id_1_created_at_1__id_1", keys: bson.D{{Key: "book_id", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}},
+			{name: "book_id_1_rating_1__id_1", keys: bson.D{{Key: "book_id", Value: 1}, {Key: "rating", Value: 1}, {Key: "_id", Value: 1}}},
+			{name: "status_1_created_at_1__id_1", keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}},
+			{
+				name:     "reader_id_1_book_id_1_unique",
+				keys:     bson.D{{Key: "reader_id", Value: 1}, {Key: "book_id", Value: 1}},
+				unique:   true,
+				replaces: "reader_id_1_book_id_1",
+			},
+		},
+	},
+}
+
+// SchemaDrift -- расхождение реальных индексов коллекции с ожидаемыми
+type SchemaDrift struct {
+	Collection string
+	Index      string
+	Reason     string
+}
+
+func (sd SchemaDrift) String() string {
+	return fmt.Sprintf("%s.%s: %s", sd.Collection, sd.Index, sd.Reason)
+}
+
+// EnsureSchema создает недостающие коллекции и индексы. Существующие индексы не изменяются и не удаляются,
+// вместо этого возвращается список расхождений с ожидаемой схемой. Индексы, которые заменяют старые,
+// и уникальные индексы над коллекциями с дубликатами создаются миграциями. Безопасно вызывать при каждом старте и до миграций
+func EnsureSchema(ctx context.Context, db *mongo.Database) ([]SchemaDrift, error) {
+	existing, err := db.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing collections: %w", err)
+	}
+
+	existingSet := make(map[string]struct{}, len(existing))
+	for _, name := range existing {
+		existingSet[name] = struct{}{}
+	}
+
+	var drifts []SchemaDrift
+	for _, coll := range expectedSchema {
+		if _, ok := existingSet[coll.name]; !ok {
+			if err = createCollection(ctx, db, coll.name); err != nil {
+				return nil, err
+			}
+		}
+
+		collDrifts, err := ensureIndexes(ctx, db.Collection(coll.name), coll.indexes)
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, collDrifts...)
+	}
+
+	return drifts, nil
+}
+
+func createCollection(ctx context.Context, db *mongo.Database, name string) error {
+	err := db.CreateCollection(ctx, name)
+
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceExists" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error creating collection %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func ensureIndexes(ctx context.Context, coll *mongo.Collection, expected []schemaIndex) ([]SchemaDrift, error) {
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing indexes of %s: %w", coll.Name(), err)
+	}
+
+	actual := make(map[string]*mongo.IndexSpecification, len(specs))
+	for _, spec := range specs {
+		actual[spec.Name] = spec
+	}
+
+	var drifts []SchemaDrift
+	var missing []mongo.IndexModel
+	expectedNames := map[string]struct{}{"_id_": {}}
+
+	for _, index := range expected {
+		expectedNames[index.name] = struct{}{}
+
+		spec, ok := actual[index.name]
+		if !ok {
+			// сервер не создаст второй индекс с теми же ключами, его заменит миграция
+			if _, pending := actual[index.replaces]; index.replaces != "" && pending {
+				expectedNames[index.replaces] = struct{}{}
+				drifts = append(drifts, SchemaDrift{
+					Collection: coll.Name(),
+					Index:      index.name,
+					Reason:     fmt.Sprintf("not created: %s must be replaced by migration", index.replaces),
+				})
+				continue
+			}
+
+			// с дубликатами сервер не создаст уникальный индекс и отклонит весь пакет, их удаляет миграция
+			if index.unique {
+				duplicated, err := hasDuplicates(ctx, coll, index.keys)
+				if err != nil {
+					return nil, err
+				}
+				if duplicated {
+					drifts = append(drifts, SchemaDrift{
+						Collection: coll.Name(),
+						Index:      index.name,
+						Reason:     "not created: collection has duplicate keys, must be deduplicated by migration",
+					})
+					continue
+				}
+			}
+
+			missing = append(missing, index.model())
+			continue
+		}
+
+		if reason := index.diff(spec); reason != "" {
+			drifts = append(drifts, SchemaDrift{Collection: coll.Name(), Index: index.name, Reason: reason})
+		}
+	}
+
+	for _, spec := range specs {
+		if _, ok := expectedNames[spec.Name]; !ok {
+			drifts = append(drifts, SchemaDrift{Collection: coll.Name(), Index: spec.Name, Reason: "unexpected index"})
+		}
+	}
+
+	if len(missing) == 0 {
+		return drifts, nil
+	}
+
+	if _, err = coll.Indexes().CreateMany(ctx, missing); err != nil {
+		return nil, fmt.Errorf("error creating indexes on %s: %w", coll.Name(), err)
+	}
+
+	return drifts, nil
+}
+
+// hasDuplicates проверяет, есть ли в коллекции документы с одинаковыми значениями ключей индекса
+func hasDuplicates(ctx context.Context, coll *mongo.Collection, keys bson.D) (bool, error) {
+	group := bson.M{}
+	for _, key := range keys {
+		group[key.Key] = "$" + key.Key
+	}
+
+	cursor, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": group, "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$limit", Value: 1}},
+	})
+	if err != nil {
+		return false, fmt.Errorf("error checking duplicates in %s: %w", coll.Name(), err)
+	}
+	defer func(cursor *mongo.Cursor, ctx context.Context) {
+		_ = cursor.Close(ctx)
+	}(cursor, ctx)
+
+	return cursor.Next(ctx), cursor.Err()
+}
+
+func (si schemaIndex) model() mongo.IndexModel {
+	opts := options.Index().SetName(si.name)
+	if si.unique {
+		opts.SetUnique(true)
+	}
+	if si.isText() {
+		// поле language у книги -- язык издания, а не язык текстового индекса
+		opts.SetDefaultLanguage("none").SetLanguageOverride("text_language")
+		if si.weights != nil {
+			opts.SetWeights(si.weights)
+		}
+	}
+
+	return mongo.IndexModel{Keys: si.keys, Options: opts}
+}
+
+func (si schemaIndex) isText() bool {
+	for _, key := range si.keys {
+		if key.Value == "text" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (si schemaIndex) diff(spec *mongo.IndexSpecification) string {
+	if si.isText() {
+		// ключи текстового индекса хранятся сервером в виде {_fts: "text", _ftsx: 1}
+		if fts, ok := spec.KeysDocument.Lookup("_fts").StringValueOK(); !ok || fts != "text" {
+			return fmt.Sprintf("keys mismatch: expected text index, got %v", spec.KeysDocument)
+		}
+	} else if !indexKeysEqual(si.keys, spec.KeysDocument) {
+		return fmt.Sprintf("keys mismatch: expected %v, got %v", si.keys, spec.KeysDocument)
+	}
+
+	unique := spec.Unique != nil && *spec.Unique
+	if unique != si.unique {
+		return fmt.Sprintf("unique mismatch: expected %t, got %t", si.unique, unique)
+	}
+
+	return ""
+}
+
+func indexKeysEqual(expected bson.D, actual bson.Raw) bool {
+	elements, err := actual.Elements()
+	if err != nil || len(elements) != len(expected) {
+		return false
+	}
+
+	for i, elem := range elements {
+		if elem.Key() != expected[i].Key {
+			return false
+		}
+
+		switch want := expected[i].Value.(type) {
+		case int:
+			got, ok := elem.Value().AsInt64OK()
+			if !ok || got != int64(want) {
+				return false
+			}
+		case string:
+			got, ok := elem.Value().StringValueOK()
+			if !ok || got != want {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return true
+}
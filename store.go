@@ -0,0 +1,255 @@
+package repoMongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/avito-tech/go-transaction-manager/trm/v2/manager"
+	"github.com/go-redis/redis/v8"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/impl"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/pkg/sweeper"
+	"github.com/nikitalystsev/BookSmart-repo-mongo/pkg/transact"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainPollInterval -- как часто Close проверяет, завершились ли операции
+const drainPollInterval = 10 * time.Millisecond
+
+// StoreConfig -- настройки подключений и фоновых задач Store
+type StoreConfig struct {
+	MongoURL      string
+	MongoUsername string
+	MongoPassword string
+	MongoDBName   string
+	MongoOptions  []ClientOption
+
+	Redis *redis.Options
+
+	// SweepInterval -- период фоновых задач истечения броней и читательских билетов.
+	// Нулевое значение означает sweeper.DefaultInterval
+	SweepInterval   time.Duration
+	DisableSweepers bool
+
+	// DisableEnsureSchema отключает создание коллекций и индексов через EnsureSchema при создании Store
+	DisableEnsureSchema bool
+
+	Logger *logrus.Entry
+}
+
+// Store владеет клиентами MongoDB и Redis, репозиториями и фоновыми задачами
+type Store struct {
+	Mongo     *mongo.Client
+	Redis     *redis.Client
+	DB        *mongo.Database
+	TrManager *manager.Manager
+	Health    *HealthChecker
+
+	Books        *impl.BookRepo
+	Readers      *impl.ReaderRepo
+	LibCards     *impl.LibCardRepo
+	Reservations *impl.ReservationRepo
+	Ratings      *impl.RatingRepo
+
+	logger        *logrus.Entry
+	monitor       *commandMonitor
+	redisInflight *inflightHook
+	stopSweepers  context.CancelFunc
+	sweepers      sync.WaitGroup
+	closeOnce     sync.Once
+	closeErr      error
+}
+
+// NewStore подключается к MongoDB и Redis, создает недостающие коллекции и индексы, создает репозитории
+// и запускает фоновые задачи.
+// Созданный Store нужно закрыть через Close
+func NewStore(ctx context.Context, cfg StoreConfig) (*Store, error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = logrus.NewEntry(logrus.StandardLogger())
+	}
+
+	if cfg.Redis == nil {
+		return nil, errors.New("redis options are required")
+	}
+
+	monitor, err := newCommandMonitor(otel.GetMeterProvider())
+	if err != nil {
+		return nil, fmt.Errorf("error creating command monitor: %w", err)
+	}
+
+	mongoOptions := append([]ClientOption{withCommandMonitor(monitor)}, cfg.MongoOptions...)
+	mongoClient, err := NewClient(cfg.MongoURL, cfg.MongoUsername, cfg.MongoPassword, cfg.MongoDBName, mongoOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	redisInflight := &inflightHook{}
+	redisClient := redis.NewClient(cfg.Redis)
+	redisClient.AddHook(redisInflight)
+	if err = redisClient.Ping(ctx).Err(); err != nil {
+		_ = redisClient.Close()
+		_ = mongoClient.Disconnect(ctx)
+		return nil, fmt.Errorf("error pinging redis: %w", err)
+	}
+
+	trManager, err := transact.NewManager(mongoClient)
+	if err != nil {
+		_ = redisClient.Close()
+		_ = mongoClient.Disconnect(ctx)
+		return nil, fmt.Errorf("error creating transaction manager: %w", err)
+	}
+
+	db := mongoClient.Database(cfg.MongoDBName)
+
+	if !cfg.DisableEnsureSchema {
+		drifts, err := EnsureSchema(ctx, db)
+		if err != nil {
+			_ = redisClient.Close()
+			_ = mongoClient.Disconnect(ctx)
+			return nil, fmt.Errorf("error ensuring schema: %w", err)
+		}
+		for _, drift := range drifts {
+			logger.Warnf("schema drift: %s", drift)
+		}
+	}
+
+	store := &Store{
+		Mongo:         mongoClient,
+		Redis:         redisClient,
+		DB:            db,
+		TrManager:     trManager,
+		Health:        NewHealthChecker(mongoClient, redisClient),
+		Books:         impl.NewBookRepo(db, logger),
+		Readers:       impl.NewReaderRepo(db, redisClient, logger),
+		LibCards:      impl.NewLibCardRepo(db, logger),
+		Reservations:  impl.NewReservationRepo(db, logger),
+		Ratings:       impl.NewRatingRepo(db, logger),
+		logger:        logger,
+		monitor:       monitor,
+		redisInflight: redisInflight,
+		stopSweepers:  func() {},
+	}
+
+	if !cfg.DisableSweepers {
+		store.startSweepers(
+			impl.NewReservationExpirer(db, logger).Sweeper(cfg.SweepInterval),
+			impl.NewLibCardExpirer(db, logger).Sweeper(cfg.SweepInterval),
+		)
+	}
+
+	return store, nil
+}
+
+func (s *Store) startSweepers(sweepers ...*sweeper.Sweeper) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopSweepers = cancel
+
+	for _, sw := range sweepers {
+		s.sweepers.Add(1)
+		go func(sw *sweeper.Sweeper) {
+			defer s.sweepers.Done()
+			sw.Run(ctx)
+		}(sw)
+	}
+}
+
+// Close останавливает фоновые задачи, ждет завершения незавершенных команд MongoDB и Redis
+// и отключает оба клиента. Если ctx истекает раньше, клиенты отключаются без ожидания.
+// Повторные вызовы возвращают результат первого
+func (s *Store) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.close(ctx)
+	})
+
+	return s.closeErr
+}
+
+func (s *Store) close(ctx context.Context) error {
+	s.logger.Infof("closing store")
+
+	var errList []error
+
+	s.stopSweepers()
+	sweepersDone := make(chan struct{})
+	go func() {
+		s.sweepers.Wait()
+		close(sweepersDone)
+	}()
+	select {
+	case <-sweepersDone:
+	case <-ctx.Done():
+		errList = append(errList, fmt.Errorf("error stopping sweepers: %w", ctx.Err()))
+	}
+
+	err := waitUntil(ctx, func() bool { return s.monitor.inflight.Load() == 0 && s.redisInflight.inflight.Load() == 0 })
+	if err != nil {
+		errList = append(errList, fmt.Errorf("error draining operations: %w", err))
+	}
+
+	// после истечения ctx отключение выполняется с новым контекстом, иначе клиент не освободит ресурсы
+	disconnectCtx := ctx
+	if ctx.Err() != nil {
+		disconnectCtx = context.Background()
+	}
+	if err = s.Mongo.Disconnect(disconnectCtx); err != nil {
+		errList = append(errList, fmt.Errorf("error disconnecting MongoDB: %w", err))
+	}
+	if err = s.Redis.Close(); err != nil {
+		errList = append(errList, fmt.Errorf("error closing redis: %w", err))
+	}
+
+	if err = errors.Join(errList...); err != nil {
+		s.logger.Errorf("error closing store: %v", err)
+		return err
+	}
+
+	s.logger.Infof("store closed")
+
+	return nil
+}
+
+// waitUntil опрашивает cond, пока оно не станет истинным или не истечет ctx
+func waitUntil(ctx context.Context, cond func() bool) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// inflightHook считает команды Redis, ожидающие ответа
+type inflightHook struct {
+	inflight atomic.Int64
+}
+
+func (h *inflightHook) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	h.inflight.Add(1)
+	return ctx, nil
+}
+
+func (h *inflightHook) AfterProcess(_ context.Context, _ redis.Cmder) error {
+	h.inflight.Add(-1)
+	return nil
+}
+
+func (h *inflightHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	h.inflight.Add(1)
+	return ctx, nil
+}
+
+func (h *inflightHook) AfterProcessPipeline(_ context.Context, _ []redis.Cmder) error {
+	h.inflight.Add(-1)
+	return nil
+}